@@ -11,6 +11,7 @@ require (
 	github.com/go-co-op/gocron v1.9.0
 	github.com/joho/godotenv v1.5.1
 	github.com/slack-go/slack v0.9.5
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	gorm.io/driver/postgres v1.1.2
 	gorm.io/gorm v1.21.15
 )
@@ -43,7 +44,6 @@ require (
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	github.com/ugorji/go/codec v1.2.6 // indirect
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
-	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359 // indirect
 	golang.org/x/text v0.3.7 // indirect
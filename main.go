@@ -2,37 +2,51 @@ package main
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
+	"context"
+	"crypto/tls"
 	"io"
 	"log"
-	"math/rand"
+	"net"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/DusanKasan/parsemail"
-	"github.com/PuerkitoBio/goquery"
+	"github.com/cjdenio/temp-email/pkg/certs"
+	"github.com/cjdenio/temp-email/pkg/config"
 	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+	"github.com/cjdenio/temp-email/pkg/imap"
+	"github.com/cjdenio/temp-email/pkg/mailauth"
+	"github.com/cjdenio/temp-email/pkg/notify"
+	"github.com/cjdenio/temp-email/pkg/pop3"
 	"github.com/cjdenio/temp-email/pkg/schedule"
 	"github.com/cjdenio/temp-email/pkg/slackevents"
-	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/cjdenio/temp-email/pkg/storage"
+	"github.com/cjdenio/temp-email/pkg/webhooks"
 	"github.com/emersion/go-smtp"
-	"github.com/slack-go/slack"
 	"gorm.io/gorm"
 
-	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/joho/godotenv"
 )
 
 type Session struct {
-	FromAddr string
-	ToAddr   string
+	Verifier   *mailauth.Verifier
+	State      smtp.ConnectionState
+	FromAddr   string
+	Recipients []recipient
+}
+
+// An address the current message is being delivered to, along with the
+// subaddress tag it was sent to, if any (e.g. "github" for abc123+github@)
+type recipient struct {
+	Address db.Address
+	Tag     string
 }
 
 func (s *Session) Reset() {
 	s.FromAddr = ""
-	s.ToAddr = ""
+	s.Recipients = nil
 }
 func (s *Session) Logout() error { return nil }
 func (s *Session) Mail(from string, opts smtp.MailOptions) error {
@@ -40,25 +54,78 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 	return nil
 }
 func (s *Session) Rcpt(to string) error {
-	s.ToAddr = to
-	return nil
-}
-func (s *Session) Data(r io.Reader) error {
-	split := strings.Split(s.ToAddr, "@")
+	split := strings.Split(to, "@")
 
 	if len(split) < 2 {
-		return errors.New("invalid address")
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Invalid address",
+		}
+	}
+
+	domain := strings.ToLower(split[len(split)-1])
+
+	var count int64
+	if tx := db.DB.Model(&db.Domain{}).Where("name = ?", domain).Count(&count); tx.Error != nil {
+		log.Println(tx.Error)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Something went wrong, try again later",
+		}
+	} else if count == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "We don't accept mail for that domain",
+		}
+	}
+
+	// abc123+github@ is delivered to abc123@, tagged with "github"
+	local := strings.SplitN(strings.ToLower(split[0]), "+", 2)
+	tag := ""
+	if len(local) == 2 {
+		tag = local[1]
 	}
 
 	var address db.Address
-	tx := db.DB.Where("id = ? AND expires_at > NOW()", split[0]).First(&address)
+	tx := db.DB.Where("id = ? AND domain = ?", local[0], domain).First(&address)
 	if tx.Error == gorm.ErrRecordNotFound {
-		return errors.New("address not found")
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such address",
+		}
 	} else if tx.Error != nil {
 		log.Println(tx.Error)
-		return nil
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Something went wrong, try again later",
+		}
 	}
 
+	if !address.ExpiresAt.After(time.Now()) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 1},
+			Message:      "This address has expired",
+		}
+	}
+
+	// The same address can show up more than once (e.g. in both To and Cc,
+	// or with different tags), but it should only get one copy of the message
+	for _, r := range s.Recipients {
+		if r.Address.ID == address.ID {
+			return nil
+		}
+	}
+
+	s.Recipients = append(s.Recipients, recipient{Address: address, Tag: tag})
+	return nil
+}
+func (s *Session) Data(r io.Reader) error {
 	rawEmail, err := io.ReadAll(r)
 	if err != nil {
 		log.Println(err)
@@ -69,108 +136,244 @@ func (s *Session) Data(r io.Reader) error {
 		log.Println(err)
 	}
 
+	var ip net.IP
+	if addr, ok := s.State.RemoteAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	auth := s.Verifier.Verify(ctx, ip, s.State.Hostname, s.FromAddr, rawEmail)
+
+	var attachments []attachment
+	for _, a := range email.Attachments {
+		data, err := io.ReadAll(a.Data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		key, err := storage.Put(data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		attachments = append(attachments, attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        data,
+			StorageKey:  key,
+		})
+	}
+
+	msg := message{
+		Raw:   string(rawEmail),
+		Email: email,
+		TLS:   s.State.TLS,
+		Auth:  auth,
+
+		Attachments: attachments,
+	}
+
+	for _, r := range s.Recipients {
+		deliver(r, msg)
+	}
+
+	return nil
+}
+
+// A received message, parsed once and then delivered to each recipient
+type message struct {
+	Raw   string
+	Email parsemail.Email
+	TLS   tls.ConnectionState
+	Auth  *mailauth.Results
+
+	Attachments []attachment
+}
+
+type attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	StorageKey  string
+}
+
+// Stores a copy of the message for the given recipient and lets them know it arrived
+func deliver(r recipient, msg message) {
+	address := r.Address
+
 	savedEmail := &db.Email{
-		ID:        util.GenerateEmailAddress(),
-		AddressID: address.ID,
-		Content:   string(rawEmail),
+		ID:          ids.Token(),
+		AddressID:   address.ID,
+		Tag:         r.Tag,
+		Content:     msg.Raw,
+		Subject:     msg.Email.Subject,
+		AuthResults: msg.Auth.Header(),
+		AuthVerdict: string(msg.Auth.Verdict()),
+	}
+	if len(msg.Email.From) > 0 {
+		savedEmail.From = msg.Email.From[0].Address
+	}
+	if msg.TLS.HandshakeComplete {
+		savedEmail.TLSVersion = certs.VersionName(msg.TLS.Version)
+		savedEmail.TLSCipher = tls.CipherSuiteName(msg.TLS.CipherSuite)
 	}
 
 	db.DB.Create(&savedEmail)
 
-	subject := email.Subject
-	if subject == "" {
-		subject = "_no subject_"
-	} else {
-		subject = fmt.Sprintf("subject: *%s*", email.Subject)
+	var savedAttachments []db.Attachment
+	var notifyAttachments []notify.Attachment
+	for _, a := range msg.Attachments {
+		savedAttachment := db.Attachment{
+			ID:          ids.Token(),
+			EmailID:     savedEmail.ID,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        int64(len(a.Data)),
+			Hash:        a.StorageKey,
+			StorageKey:  a.StorageKey,
+		}
+		db.DB.Create(&savedAttachment)
+		savedAttachments = append(savedAttachments, savedAttachment)
+		notifyAttachments = append(notifyAttachments, notify.Attachment{Attachment: savedAttachment, Data: a.Data})
 	}
 
-	body := ""
+	webhooks.Enqueue(*savedEmail, address, msg.Email, savedAttachments)
 
-	if email.HTMLBody != "" {
-		converter := md.NewConverter("", true, &md.Options{
-			StrongDelimiter: "*",
-			EmDelimiter:     "_",
-		})
-
-		converter.AddRules(
-			md.Rule{
-				Filter: []string{"a"},
-				Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
-					return md.String(fmt.Sprintf("<%s|%s>", selec.AttrOr("href", content), content))
-				},
-			},
-			md.Rule{
-				Filter: []string{"h1", "h2", "h3", "h4", "h5", "h6"},
-				Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
-					return md.String("\n\n*" + content + "*\n\n")
-				},
-			},
-			md.Rule{
-				Filter: []string{"img"},
-				Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
-					return md.String("")
-				},
-			},
-		)
-
-		body, err = converter.ConvertString(email.HTMLBody)
-		if err != nil {
-			return errors.New("error parsing message")
-		}
-	} else {
-		body = email.TextBody
-	}
-
-	_, _, err = slackevents.Client.PostMessage(
-		os.Getenv("SLACK_CHANNEL"),
-		slack.MsgOptionDisableLinkUnfurl(),
-		slack.MsgOptionDisableMediaUnfurl(),
-		slack.MsgOptionTS(address.Timestamp),
-		slack.MsgOptionBlocks(
-			slack.NewSectionBlock(
-				slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("message from %s\n%s", email.From[0].Address, util.SanitizeInput(subject)), false, false),
-				nil,
-				nil,
-			),
-			slack.NewDividerBlock(),
-			slack.NewSectionBlock(
-				slack.NewTextBlockObject("mrkdwn", util.SanitizeInput(body), false, false),
-				nil,
-				nil,
-			),
-			slack.NewDividerBlock(),
-			slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("Not rendering properly? Click <%s/%s|here> to view this email in your browser.", os.Getenv("APP_DOMAIN"), savedEmail.ID), false, false)),
-		),
-	)
+	err := notify.For(address).NewMail(notify.Mail{
+		Address:     address,
+		Email:       *savedEmail,
+		Parsed:      msg.Email,
+		Attachments: notifyAttachments,
+	})
 	if err != nil {
 		log.Println(err)
 	}
-
-	return nil
 }
 
-type Backend struct{}
+type Backend struct {
+	Verifier *mailauth.Verifier
+}
 
 func (b Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
 	return nil, smtp.ErrAuthUnsupported
 }
 
 func (b Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &Session{}, nil
+	return &Session{Verifier: b.Verifier, State: *state}, nil
 }
 
 func main() {
 	godotenv.Load()
-	rand.Seed(time.Now().UnixNano())
+	config.Load()
 
 	db.Connect()
 
-	backend := Backend{}
+	backend := Backend{
+		Verifier: &mailauth.Verifier{
+			Resolver: net.DefaultResolver,
+			Hostname: os.Getenv("DOMAIN"),
+		},
+	}
 	server := smtp.NewServer(backend)
 
 	server.Addr = ":3000"
 	server.Domain = os.Getenv("DOMAIN")
 
+	// Enable STARTTLS (and optionally implicit TLS) if we've got a certificate
+	if os.Getenv("TLS_CERT") != "" && os.Getenv("TLS_KEY") != "" {
+		reloader, err := certs.NewReloader(os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server.TLSConfig = reloader.Config()
+
+		if os.Getenv("SMTP_TLS_ADDR") != "" {
+			tlsServer := smtp.NewServer(backend)
+
+			tlsServer.Addr = os.Getenv("SMTP_TLS_ADDR")
+			tlsServer.Domain = os.Getenv("DOMAIN")
+			tlsServer.TLSConfig = server.TLSConfig
+
+			go func() {
+				log.Println("Starting up implicit TLS SMTP server...")
+
+				err := tlsServer.ListenAndServeTLS()
+				if err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+
+	// Let mail clients read addresses over IMAP if asked to
+	if os.Getenv("IMAP_ADDR") != "" {
+		imapServer := &imap.Server{
+			Addr:      os.Getenv("IMAP_ADDR"),
+			TLSConfig: server.TLSConfig,
+		}
+
+		go func() {
+			log.Println("Starting up IMAP server...")
+
+			err := imapServer.ListenAndServe()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if os.Getenv("IMAP_TLS_ADDR") != "" && server.TLSConfig != nil {
+		imapTLSServer := &imap.Server{
+			Addr:      os.Getenv("IMAP_TLS_ADDR"),
+			TLSConfig: server.TLSConfig,
+		}
+
+		go func() {
+			log.Println("Starting up implicit TLS IMAP server...")
+
+			err := imapTLSServer.ListenAndServeTLS()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// And over POP3, for tools that only speak that
+	if os.Getenv("POP3_ADDR") != "" {
+		pop3Server := &pop3.Server{
+			Addr:      os.Getenv("POP3_ADDR"),
+			TLSConfig: server.TLSConfig,
+		}
+
+		go func() {
+			log.Println("Starting up POP3 server...")
+
+			err := pop3Server.ListenAndServe()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if os.Getenv("POP3_TLS_ADDR") != "" && server.TLSConfig != nil {
+		pop3TLSServer := &pop3.Server{
+			Addr:      os.Getenv("POP3_TLS_ADDR"),
+			TLSConfig: server.TLSConfig,
+		}
+
+		go func() {
+			log.Println("Starting up implicit TLS POP3 server...")
+
+			err := pop3TLSServer.ListenAndServeTLS()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// Spin up an SMTP server in a goroutine
 	go func() {
 		log.Println("Starting up SMTP server...")
@@ -183,6 +386,7 @@ func main() {
 
 	// Start the scheduler
 	schedule.Start()
+	webhooks.Start()
 
 	// Start listening for Slack events
 	slackevents.Start()
@@ -0,0 +1,95 @@
+package certs
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate/key pair from disk, picking up changes
+// (e.g. a certbot renewal) without restarting the server
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) reload() error {
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+
+	log.Println("Loaded TLS certificate from", r.CertFile)
+
+	return nil
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate. If the
+// files on disk can't be loaded, the last good certificate keeps being served.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		log.Println("Error reloading TLS certificate:", err)
+	}
+
+	return r.cert, nil
+}
+
+// Config returns a TLS config backed by this reloader
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// VersionName returns a human-readable name for a TLS version
+func VersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/util"
+)
+
+var (
+	// How long a new address lives if the user doesn't ask for anything else
+	DefaultTTL = 24 * time.Hour
+
+	// The furthest into the future an address's expiry can be pushed, whether
+	// on creation or by extending it
+	MaxTTL = 7 * 24 * time.Hour
+
+	// How many times an address can be extended, 0 means no limit
+	MaxExtensions = 0
+
+	// How generated addresses look: "random" uses AddressLength characters
+	// from AddressAlphabet, "words" gives something like brave-otter-42
+	AddressStyle    = "random"
+	AddressLength   = 6
+	AddressAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	// How long signed inbox links keep working
+	InboxLinkTTL = 7 * 24 * time.Hour
+)
+
+// Load reads settings from the environment, falling back to the defaults
+// above. It should be called after the .env file has been loaded.
+func Load() {
+	DefaultTTL = durationEnv("ADDRESS_TTL", DefaultTTL)
+	MaxTTL = durationEnv("ADDRESS_MAX_TTL", MaxTTL)
+	MaxExtensions = intEnv("ADDRESS_MAX_EXTENSIONS", MaxExtensions)
+	InboxLinkTTL = durationEnv("INBOX_LINK_TTL", InboxLinkTTL)
+
+	if DefaultTTL > MaxTTL {
+		log.Fatalf("ADDRESS_TTL (%s) can't be longer than ADDRESS_MAX_TTL (%s)", DefaultTTL, MaxTTL)
+	}
+
+	if style := os.Getenv("ADDRESS_STYLE"); style != "" {
+		AddressStyle = style
+	}
+	if AddressStyle != "random" && AddressStyle != "words" {
+		log.Fatalf("invalid ADDRESS_STYLE %q, expected \"random\" or \"words\"", AddressStyle)
+	}
+
+	AddressLength = intEnv("ADDRESS_LENGTH", AddressLength)
+	if AddressLength < 4 || AddressLength > 64 {
+		log.Fatalf("ADDRESS_LENGTH must be between 4 and 64")
+	}
+
+	if alphabet := os.Getenv("ADDRESS_ALPHABET"); alphabet != "" {
+		AddressAlphabet = alphabet
+	}
+	// Generated addresses have to be valid local parts
+	for _, c := range AddressAlphabet {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			log.Fatalf("ADDRESS_ALPHABET can only contain lowercase letters, numbers, hyphens and underscores")
+		}
+	}
+	if len(AddressAlphabet) < 2 {
+		log.Fatalf("ADDRESS_ALPHABET needs at least 2 characters")
+	}
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := util.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return d
+}
+
+func intEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return n
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"log"
 	"os"
+	"strings"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -18,5 +19,21 @@ func Connect() {
 
 	DB = _db
 
-	DB.AutoMigrate(&Address{}, &Email{})
+	DB.AutoMigrate(&Domain{}, &Address{}, &Email{}, &Attachment{}, &APIToken{}, &Webhook{}, &WebhookDelivery{})
+
+	// The domain from DOMAIN is always accepted, and addresses from before
+	// multiple domains were supported belong to it
+	if domain := os.Getenv("DOMAIN"); domain != "" {
+		DB.Where(Domain{Name: strings.ToLower(domain)}).Attrs(Domain{SlackChannel: os.Getenv("SLACK_CHANNEL")}).FirstOrCreate(&Domain{})
+		DB.Model(&Address{}).Where("domain = '' OR domain IS NULL").Update("domain", strings.ToLower(domain))
+	}
+	// Other domains can be added here or straight in the domains table,
+	// which is also where their channel and lifetime settings live
+	for _, domain := range strings.Split(os.Getenv("EXTRA_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			DB.Where(Domain{Name: strings.ToLower(domain)}).FirstOrCreate(&Domain{})
+		}
+	}
+
+	DB.Model(&Address{}).Where("channel = '' OR channel IS NULL").Update("channel", os.Getenv("SLACK_CHANNEL"))
 }
@@ -2,13 +2,39 @@ package db
 
 import "time"
 
+type Domain struct {
+	Name      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	// Where threads for addresses on this domain are started, and where
+	// "gib email" picks this domain. Empty means SLACK_CHANNEL.
+	SlackChannel string
+
+	// Lifetime limits for addresses on this domain. Zero means use the
+	// global ADDRESS_TTL and ADDRESS_MAX_TTL.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
 type Address struct {
 	ID                 string `gorm:"primaryKey"`
 	CreatedAt          time.Time
 	ExpiresAt          time.Time
+	Domain             string
+	Channel            string
 	Timestamp          string
 	User               string
 	ExpiredMessageSent bool `gorm:"default:false"`
+	Extensions         int  `gorm:"default:0"`
+
+	// Where notifications about this address go, e.g. "discord" with a
+	// webhook URL as the target. Empty means its Slack thread.
+	Notifier       string
+	NotifierTarget string
+
+	// Hash of the password IMAP and POP3 clients log in with, issued
+	// through Slack. Empty means mail clients can't log in.
+	AppPasswordHash string
 }
 
 type Email struct {
@@ -17,4 +43,92 @@ type Email struct {
 	Address   Address
 	AddressID string
 	Content   string
+
+	// Subaddress tag the email was sent to, e.g. "github" for abc123+github@
+	Tag string `gorm:"index"`
+
+	// Copied out of Content so listings don't have to parse every message
+	From    string
+	Subject string
+
+	// Negotiated TLS parameters, empty if the message arrived in plaintext
+	TLSVersion string
+	TLSCipher  string
+
+	// SPF/DKIM/DMARC results, formatted like an Authentication-Results
+	// header, and a pass/fail/none summary of them
+	AuthResults string
+	AuthVerdict string
+
+	// Numbered in the order emails arrive, for IMAP and POP3 clients
+	UID uint32 `gorm:"autoIncrement;uniqueIndex"`
+
+	// Set when an IMAP client marks the email as read
+	Seen bool `gorm:"default:false"`
+
+	// Set when a POP3 client deletes the email. Mail clients won't see it
+	// anymore, but it's still in Slack and the web viewer.
+	Deleted bool `gorm:"default:false"`
+
+	// The thread reply it was posted as, so it can be replied to from Slack
+	SlackTimestamp string `gorm:"index"`
+}
+
+type Attachment struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	Email       Email
+	EmailID     string `gorm:"index"`
+	Filename    string
+	ContentType string
+	Size        int64
+	Hash        string
+	StorageKey  string
+}
+
+// Lets a user call the JSON API. Only a hash of the token is kept, so it
+// can't be shown again after it's issued.
+type APIToken struct {
+	ID         uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	User       string `gorm:"index"`
+	Name       string
+	Hash       string `gorm:"uniqueIndex"`
+	LastUsedAt *time.Time
+}
+
+// An HTTP endpoint that gets a signed JSON payload for every email one of a
+// user's addresses receives, or just one address if AddressID is set
+type Webhook struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	User      string `gorm:"index"`
+	AddressID string `gorm:"index"`
+	URL       string
+
+	// Key for the payload's HMAC signature. Unlike API tokens this has to be
+	// kept around to sign with.
+	Secret string
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// One attempt, or series of retries, at sending an email to a webhook
+type WebhookDelivery struct {
+	ID            uint `gorm:"primaryKey"`
+	CreatedAt     time.Time
+	Webhook       Webhook `gorm:"constraint:OnDelete:CASCADE"`
+	WebhookID     uint    `gorm:"index"`
+	EmailID       string
+	Payload       string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastStatus    int
+	LastError     string
+	DeliveredAt   *time.Time
 }
@@ -0,0 +1,74 @@
+// Package ids generates address local parts and the unguessable tokens that
+// guard public URLs. Everything here is backed by crypto/rand.
+package ids
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/cjdenio/temp-email/pkg/config"
+)
+
+// Lowercase so tokens survive case-insensitive handling in mail clients
+const tokenAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// 32 characters from a 36-character alphabet is a little over 165 bits
+const tokenLength = 32
+
+func randomIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand only fails if the OS can't give us randomness, in which
+		// case nothing we hand out would be safe anyway
+		panic(err)
+	}
+	return int(i.Int64())
+}
+
+func randomString(alphabet string, length int) string {
+	chars := []rune(alphabet)
+	generated := make([]rune, length)
+
+	for i := range generated {
+		generated[i] = chars[randomIndex(len(chars))]
+	}
+
+	return string(generated)
+}
+
+// Address generates a local part for a new address, according to the
+// configured style
+func Address() string {
+	if config.AddressStyle == "words" {
+		return Words()
+	}
+
+	return randomString(config.AddressAlphabet, config.AddressLength)
+}
+
+// Words generates a memorable local part like brave-otter-42
+func Words() string {
+	return fmt.Sprintf("%s-%s-%d", adjectives[randomIndex(len(adjectives))], nouns[randomIndex(len(nouns))], randomIndex(100))
+}
+
+// Token generates a long, unguessable ID for things that are accessible to
+// anyone who knows it, like the web view of an email
+func Token() string {
+	return randomString(tokenAlphabet, tokenLength)
+}
+
+// Secret generates a credential to hand to a user, like an API token. Only
+// its Hash should be stored.
+func Secret(prefix string) string {
+	return prefix + Token()
+}
+
+// Hash returns the hex-encoded SHA-256 of a secret. Secrets are long and
+// random, so there's no need for a slow password hash.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,23 @@
+package ids
+
+var adjectives = []string{
+	"agile", "bold", "brave", "breezy", "bright", "calm", "cheerful", "clever",
+	"cosmic", "cozy", "crisp", "curious", "daring", "dizzy", "eager", "fancy",
+	"fluffy", "fuzzy", "gentle", "giddy", "glad", "golden", "grand", "happy",
+	"hasty", "humble", "jolly", "keen", "kind", "lively", "lucky", "mellow",
+	"merry", "mighty", "misty", "nimble", "noble", "peppy", "plucky", "polite",
+	"proud", "quick", "quiet", "rapid", "rosy", "rusty", "shiny", "silly",
+	"sleepy", "sly", "snappy", "speedy", "spicy", "sunny", "swift", "tidy",
+	"tiny", "witty", "zany", "zesty",
+}
+
+var nouns = []string{
+	"badger", "beaver", "bison", "camel", "cheetah", "cobra", "coyote", "crab",
+	"crane", "dingo", "dolphin", "eagle", "falcon", "ferret", "finch", "fox",
+	"gecko", "goose", "hawk", "hedgehog", "heron", "ibis", "jackal", "koala",
+	"lemur", "llama", "lynx", "marmot", "moose", "newt", "ocelot", "octopus",
+	"orca", "otter", "owl", "panda", "parrot", "pelican", "penguin", "puffin",
+	"quokka", "rabbit", "raccoon", "raven", "salmon", "seal", "shark", "sloth",
+	"squid", "stoat", "swan", "tapir", "tiger", "toad", "turtle", "walrus",
+	"weasel", "whale", "wombat", "yak",
+}
@@ -0,0 +1,227 @@
+// Package imageproxy fetches remote images on behalf of the web viewer, so
+// senders never see the IP addresses of people reading their emails
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+	"github.com/cjdenio/temp-email/pkg/signing"
+)
+
+// Where the proxy is mounted
+const Path = "/proxy/image"
+
+var (
+	errTooLarge   = errors.New("image too large")
+	errNotAnImage = errors.New("not an image")
+)
+
+type Proxy struct {
+	Client *http.Client
+
+	// The largest image that will be fetched
+	MaxBytes int64
+
+	// How long fetched images are kept, and how many bytes of them
+	CacheTTL   time.Duration
+	CacheBytes int64
+
+	mu        sync.Mutex
+	cache     map[string]*entry
+	cacheSize int64
+}
+
+type entry struct {
+	ContentType string
+	Data        []byte
+	FetchedAt   time.Time
+}
+
+// New creates a proxy configured from IMAGE_PROXY_MAX_BYTES and
+// IMAGE_PROXY_CACHE_BYTES. It won't connect to private or loopback
+// addresses.
+func New() *Proxy {
+	p := &Proxy{
+		Client:     safehttp.NewClient(false),
+		MaxBytes:   5 << 20,
+		CacheTTL:   time.Hour,
+		CacheBytes: 64 << 20,
+	}
+
+	if n, err := strconv.ParseInt(os.Getenv("IMAGE_PROXY_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		p.MaxBytes = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("IMAGE_PROXY_CACHE_BYTES"), 10, 64); err == nil && n >= 0 {
+		p.CacheBytes = n
+	}
+
+	return p
+}
+
+func signingMessage(remote string) string {
+	return "image|" + remote
+}
+
+// URL returns the proxied version of a remote image URL. Only http and https
+// URLs are proxied; anything else comes back empty.
+func (p *Proxy) URL(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if strings.HasPrefix(remote, "//") {
+		remote = "https:" + remote
+	}
+
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	return Path + "?" + url.Values{
+		"url": {remote},
+		"sig": {signing.Sign(signingMessage(remote))},
+	}.Encode()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remote := r.URL.Query().Get("url")
+	if remote == "" || !signing.Verify(signingMessage(remote), r.URL.Query().Get("sig")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	e, err := p.get(r.Context(), remote)
+	if err != nil {
+		log.Printf("image proxy: %s: %v", remote, err)
+
+		status := http.StatusBadGateway
+		if err == errTooLarge || err == errNotAnImage {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", e.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(e.Data)
+}
+
+func (p *Proxy) get(ctx context.Context, remote string) (*entry, error) {
+	if e := p.cached(remote); e != nil {
+		return e, nil
+	}
+
+	e, err := p.fetch(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	p.store(remote, e)
+	return e, nil
+}
+
+func (p *Proxy) fetch(ctx context.Context, remote string) (*entry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origin responded with %s", resp.Status)
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	// SVGs can contain scripts, so they're not treated as images here
+	if err != nil || !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		return nil, errNotAnImage
+	}
+
+	if resp.ContentLength > p.MaxBytes {
+		return nil, errTooLarge
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, p.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > p.MaxBytes {
+		return nil, errTooLarge
+	}
+
+	return &entry{ContentType: contentType, Data: data, FetchedAt: time.Now()}, nil
+}
+
+func (p *Proxy) cached(remote string) *entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.cache[remote]
+	if !ok {
+		return nil
+	}
+	if time.Since(e.FetchedAt) > p.CacheTTL {
+		p.remove(remote)
+		return nil
+	}
+	return e
+}
+
+func (p *Proxy) store(remote string, e *entry) {
+	size := int64(len(e.Data))
+	if size > p.CacheBytes {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cache == nil {
+		p.cache = map[string]*entry{}
+	}
+	p.remove(remote)
+
+	// Make room by dropping the oldest images first
+	for p.cacheSize+size > p.CacheBytes {
+		oldest := ""
+		for key, cached := range p.cache {
+			if oldest == "" || cached.FetchedAt.Before(p.cache[oldest].FetchedAt) {
+				oldest = key
+			}
+		}
+		p.remove(oldest)
+	}
+
+	p.cache[remote] = e
+	p.cacheSize += size
+}
+
+// Must be called with mu held
+func (p *Proxy) remove(remote string) {
+	if e, ok := p.cache[remote]; ok {
+		p.cacheSize -= int64(len(e.Data))
+		delete(p.cache, remote)
+	}
+}
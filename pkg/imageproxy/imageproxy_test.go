@@ -0,0 +1,255 @@
+package imageproxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+)
+
+var png = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+func newOrigin(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	})
+	mux.HandleFunc("/params.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg; charset=binary")
+		w.Write(png)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<script>alert(1)</script>"))
+	})
+	mux.HandleFunc("/logo.svg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+	})
+	mux.HandleFunc("/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		w.Write(png)
+	})
+	mux.HandleFunc("/big.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte{0}, 2048))
+	})
+	mux.HandleFunc("/streamed.png", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing first means there's no Content-Length to go by
+		w.Header().Set("Content-Type", "image/png")
+		w.(http.Flusher).Flush()
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat([]byte{0}, 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/missing.png", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	origin := httptest.NewServer(mux)
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// The test servers are all on loopback, so this proxy is allowed to connect
+// to them
+func newProxy() *Proxy {
+	return &Proxy{
+		Client:     safehttp.NewClient(true),
+		MaxBytes:   1024,
+		CacheTTL:   time.Hour,
+		CacheBytes: 1 << 20,
+	}
+}
+
+func get(p *Proxy, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestServeHTTP(t *testing.T) {
+	origin := newOrigin(t)
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/cat.png", http.StatusOK, "image/png"},
+		{"/params.jpg", http.StatusOK, "image/jpeg"},
+		{"/page.html", http.StatusUnprocessableEntity, ""},
+		{"/logo.svg", http.StatusUnprocessableEntity, ""},
+		{"/untyped", http.StatusUnprocessableEntity, ""},
+		{"/big.png", http.StatusUnprocessableEntity, ""},
+		{"/streamed.png", http.StatusUnprocessableEntity, ""},
+		{"/missing.png", http.StatusBadGateway, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p := newProxy()
+
+			w := get(p, p.URL(origin.URL+tt.path))
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.contentType)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q", got)
+			}
+			if !bytes.Equal(w.Body.Bytes(), png) {
+				t.Errorf("body doesn't match the origin's")
+			}
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer origin.Close()
+
+	p := newProxy()
+	signed, _ := url.Parse(p.URL(origin.URL + "/cat.png"))
+	other, _ := url.Parse(p.URL(origin.URL + "/dog.png"))
+
+	tests := map[string]url.Values{
+		"no signature": {"url": {origin.URL + "/cat.png"}},
+		"bad signature": {
+			"url": {origin.URL + "/cat.png"},
+			"sig": {strings.Repeat("0", len(signed.Query().Get("sig")))},
+		},
+		"another URL's signature": {
+			"url": {origin.URL + "/cat.png"},
+			"sig": {other.Query().Get("sig")},
+		},
+		"no URL": {"sig": {signed.Query().Get("sig")}},
+	}
+
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			if w := get(p, Path+"?"+query.Encode()); w.Code != http.StatusForbidden {
+				t.Errorf("got %d, want 403", w.Code)
+			}
+		})
+	}
+	if hits != 0 {
+		t.Errorf("origin was contacted %d times for unsigned URLs", hits)
+	}
+
+	if w := get(p, signed.String()); w.Code != http.StatusOK {
+		t.Errorf("properly signed URL got %d", w.Code)
+	}
+}
+
+func TestRedirectToPrivateAddress(t *testing.T) {
+	var internalHits int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&internalHits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer internal.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/secret.png", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	// The origin is on loopback too, so it stands in for a public server by
+	// being the one address the guard lets through
+	originAddr := origin.Listener.Addr().String()
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if address == originAddr {
+				return nil
+			}
+			return safehttp.Guard(network, address, c)
+		},
+	}
+
+	p := newProxy()
+	p.Client = safehttp.NewClient(false)
+	p.Client.Transport = &http.Transport{DialContext: dialer.DialContext}
+
+	if w := get(p, p.URL(origin.URL+"/cat.png")); w.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", w.Code)
+	}
+	if internalHits != 0 {
+		t.Errorf("proxy followed the redirect to a private address")
+	}
+
+	// Without the exception, the origin itself is off limits
+	p.Client = safehttp.NewClient(false)
+	if w := get(p, p.URL(internal.URL+"/secret.png")); w.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", w.Code)
+	}
+	if internalHits != 0 {
+		t.Errorf("proxy connected to a private address")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer origin.Close()
+
+	p := newProxy()
+	for i := 0; i < 3; i++ {
+		if w := get(p, p.URL(origin.URL+"/cat.png")); w.Code != http.StatusOK {
+			t.Fatalf("got %d", w.Code)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("origin was hit %d times, want 1", hits)
+	}
+
+	// Too big for the cache
+	p.CacheBytes = int64(len(png)) - 1
+	get(p, p.URL(origin.URL+"/dog.png"))
+	get(p, p.URL(origin.URL+"/dog.png"))
+	if hits != 3 {
+		t.Errorf("origin was hit %d times, want 3", hits)
+	}
+}
+
+func TestURL(t *testing.T) {
+	p := newProxy()
+
+	for _, remote := range []string{"javascript:alert(1)", "data:image/png;base64,AAAA", "file:///etc/passwd", "cid:image001", ""} {
+		if got := p.URL(remote); got != "" {
+			t.Errorf("URL(%q) = %q, want nothing", remote, got)
+		}
+	}
+
+	u, err := url.Parse(p.URL("//example.com/cat.png"))
+	if err != nil || u.Path != Path || u.Query().Get("url") != "https://example.com/cat.png" {
+		t.Errorf("protocol-relative URL proxied as %q", u)
+	}
+}
@@ -0,0 +1,313 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type fetchItem struct {
+	Name string
+
+	// For BODY[...], what's inside the brackets and the optional <start.count>
+	HasSection bool
+	Section    string
+	Peek       bool
+	Partial    bool
+	Start      int
+	Count      int
+}
+
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+func parseFetchItems(arg interface{}) ([]fetchItem, error) {
+	var args []interface{}
+	if l, ok := arg.(list); ok {
+		args = l
+	} else if a, ok := arg.(atom); ok {
+		if macro, ok := fetchMacros[strings.ToUpper(string(a))]; ok {
+			for _, name := range macro {
+				args = append(args, atom(name))
+			}
+		} else {
+			args = []interface{}{a}
+		}
+	} else {
+		return nil, bad("Invalid fetch items")
+	}
+
+	var items []fetchItem
+	for _, arg := range args {
+		a, ok := arg.(atom)
+		if !ok {
+			return nil, bad("Invalid fetch item")
+		}
+
+		item, err := parseFetchItem(string(a))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func parseFetchItem(s string) (fetchItem, error) {
+	upper := strings.ToUpper(s)
+
+	switch upper {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{Name: upper}, nil
+	}
+
+	item := fetchItem{Name: "BODY", HasSection: true}
+	if strings.HasPrefix(upper, "BODY.PEEK[") {
+		item.Peek = true
+	} else if !strings.HasPrefix(upper, "BODY[") {
+		return item, bad("Unknown fetch item %s", s)
+	}
+
+	open := strings.Index(upper, "[")
+	end := strings.LastIndex(upper, "]")
+	if end < open {
+		return item, bad("Invalid section")
+	}
+	item.Section = upper[open+1 : end]
+
+	if rest := upper[end+1:]; rest != "" {
+		if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+			return item, bad("Invalid partial")
+		}
+
+		split := strings.SplitN(rest[1:len(rest)-1], ".", 2)
+		start, err1 := strconv.Atoi(split[0])
+		if err1 != nil || start < 0 || len(split) != 2 {
+			return item, bad("Invalid partial")
+		}
+		count, err2 := strconv.Atoi(split[1])
+		if err2 != nil || count <= 0 {
+			return item, bad("Invalid partial")
+		}
+
+		item.Partial = true
+		item.Start, item.Count = start, count
+	}
+
+	return item, nil
+}
+
+func (c *conn) fetch(cmd command, uid bool) error {
+	if len(cmd.Args) != 2 {
+		return bad("Expected a sequence set and fetch items")
+	}
+
+	indexes, err := c.resolve(cmd.Args[0], uid)
+	if err != nil {
+		return err
+	}
+	items, err := parseFetchItems(cmd.Args[1])
+	if err != nil {
+		return err
+	}
+
+	// UID FETCH always includes the UID
+	if uid {
+		hasUID := false
+		for _, item := range items {
+			if item.Name == "UID" {
+				hasUID = true
+			}
+		}
+		if !hasUID {
+			items = append([]fetchItem{{Name: "UID"}}, items...)
+		}
+	}
+
+	// Reading a message's contents marks it as read
+	markSeen := false
+	for _, item := range items {
+		if (item.HasSection && !item.Peek) || item.Name == "RFC822" || item.Name == "RFC822.TEXT" {
+			markSeen = true
+		}
+	}
+
+	for _, i := range indexes {
+		wasSeen := c.messages[i].Seen
+		if markSeen && !c.readOnly && !wasSeen {
+			if err := c.setSeen([]int{i}, true); err != nil {
+				return err
+			}
+		}
+
+		var fields []string
+		sentFlags := false
+		for _, item := range items {
+			field, err := c.fetchField(i, item)
+			if err != nil {
+				return err
+			}
+			if item.Name == "FLAGS" {
+				sentFlags = true
+			}
+			fields = append(fields, field)
+		}
+
+		if c.messages[i].Seen != wasSeen && !sentFlags {
+			fields = append(fields, "FLAGS "+flags(c.messages[i]))
+		}
+
+		c.writef("* %d FETCH (%s)", i+1, strings.Join(fields, " "))
+	}
+
+	c.ok(cmd, "FETCH completed")
+	return nil
+}
+
+func (c *conn) fetchField(i int, item fetchItem) (string, error) {
+	m := c.messages[i]
+
+	switch item.Name {
+	case "UID":
+		return fmt.Sprintf("UID %d", m.UID), nil
+	case "FLAGS":
+		return "FLAGS " + flags(m), nil
+	case "INTERNALDATE":
+		return fmt.Sprintf(`INTERNALDATE "%s"`, m.CreatedAt.Format("02-Jan-2006 15:04:05 -0700")), nil
+	case "RFC822.SIZE":
+		p := c.message(i)
+		return fmt.Sprintf("RFC822.SIZE %d", len(p.Header)+len(p.Body)), nil
+	case "ENVELOPE":
+		return "ENVELOPE " + c.message(i).envelope(), nil
+	case "BODYSTRUCTURE":
+		return "BODYSTRUCTURE " + c.message(i).structure(true), nil
+	case "RFC822":
+		return "RFC822 " + literal(c.message(i).raw()), nil
+	case "RFC822.HEADER":
+		return "RFC822.HEADER " + literal(c.message(i).Header), nil
+	case "RFC822.TEXT":
+		return "RFC822.TEXT " + literal(c.message(i).Body), nil
+	}
+
+	// Plain BODY, without a section, is the structure
+	if !item.HasSection {
+		return "BODY " + c.message(i).structure(false), nil
+	}
+
+	data, err := c.message(i).section(item.Section)
+	if err != nil {
+		return "", err
+	}
+
+	label := "BODY[" + item.Section + "]"
+	if item.Partial {
+		label += fmt.Sprintf("<%d>", item.Start)
+
+		if item.Start > len(data) {
+			data = nil
+		} else {
+			data = data[item.Start:]
+		}
+		if len(data) > item.Count {
+			data = data[:item.Count]
+		}
+	}
+
+	return label + " " + literal(data), nil
+}
+
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// Finds the contents of a BODY[...] section, e.g. "", "HEADER", "1.2",
+// "2.MIME" or "HEADER.FIELDS (FROM TO)"
+func (p *part) section(section string) ([]byte, error) {
+	cur := p
+	numbered := false
+
+	for section != "" && section[0] >= '0' && section[0] <= '9' {
+		end := strings.IndexByte(section, '.')
+		if end < 0 {
+			end = len(section)
+		}
+
+		n, err := strconv.Atoi(section[:end])
+		if err != nil || n < 1 {
+			return nil, bad("Invalid section")
+		}
+
+		section = strings.TrimPrefix(section[end:], ".")
+
+		// Part numbers inside an attached message refer to its parts
+		if numbered && cur.Message != nil {
+			cur = cur.Message
+		}
+
+		if len(cur.Parts) > 0 {
+			if n > len(cur.Parts) {
+				return nil, no("No such part")
+			}
+			cur = cur.Parts[n-1]
+		} else if n != 1 {
+			return nil, no("No such part")
+		}
+
+		numbered = true
+	}
+
+	if section == "" {
+		if !numbered {
+			return cur.raw(), nil
+		}
+		return cur.Body, nil
+	}
+
+	if section == "MIME" {
+		if !numbered {
+			return nil, bad("Invalid section")
+		}
+		return cur.Header, nil
+	}
+
+	// The rest apply to a message, either this one or an attached one
+	if numbered {
+		if cur.Message == nil {
+			return nil, no("That part isn't a message")
+		}
+		cur = cur.Message
+	}
+
+	switch {
+	case section == "HEADER":
+		return cur.Header, nil
+	case section == "TEXT":
+		return cur.Body, nil
+	case strings.HasPrefix(section, "HEADER.FIELDS"):
+		not := strings.HasPrefix(section, "HEADER.FIELDS.NOT")
+
+		rest := strings.TrimPrefix(strings.TrimPrefix(section, "HEADER.FIELDS.NOT"), "HEADER.FIELDS")
+		args, err := (&parser{s: rest}).parseList(false)
+		if err != nil || len(args) != 1 {
+			return nil, bad("Invalid header list")
+		}
+		l, ok := args[0].(list)
+		if !ok {
+			return nil, bad("Invalid header list")
+		}
+
+		var names []string
+		for _, name := range l {
+			s, _ := asString(name)
+			names = append(names, s)
+		}
+
+		return cur.filterHeader(names, not), nil
+	}
+
+	return nil, bad("Invalid section")
+}
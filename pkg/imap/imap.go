@@ -0,0 +1,724 @@
+// Package imap is a small IMAP4rev1 server that lets mail clients read an
+// address's emails. Each address has a single read-only INBOX, and the only
+// thing clients can change is whether an email has been read.
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/mailbox"
+)
+
+// Clients are expected to poll with NOOP well within this
+const idleTimeout = 30 * time.Minute
+
+type Server struct {
+	Addr string
+
+	// Enables STARTTLS, and is needed for ListenAndServeTLS
+	TLSConfig *tls.Config
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but with implicit TLS
+func (s *Server) ListenAndServeTLS() error {
+	l, err := tls.Listen("tcp", s.Addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(c)
+	}
+}
+
+// A command's tagged response when it doesn't succeed
+type statusError struct {
+	Status string
+	Text   string
+}
+
+func (e *statusError) Error() string {
+	return e.Status + " " + e.Text
+}
+
+func no(format string, args ...interface{}) error {
+	return &statusError{Status: "NO", Text: fmt.Sprintf(format, args...)}
+}
+
+func bad(format string, args ...interface{}) error {
+	return &statusError{Status: "BAD", Text: fmt.Sprintf(format, args...)}
+}
+
+var errLogout = errors.New("logout")
+
+type conn struct {
+	server *Server
+	c      net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	// Set once logged in
+	address *db.Address
+
+	// The selected INBOX, in sequence number order
+	selected bool
+	readOnly bool
+	messages []db.Email
+	parsed   map[uint32]*part
+}
+
+func (s *Server) handle(c net.Conn) {
+	cn := &conn{
+		server: s,
+		c:      c,
+		r:      bufio.NewReader(c),
+		w:      bufio.NewWriter(c),
+	}
+
+	cn.serve()
+}
+
+// Talks to the client until it logs out or goes away
+func (c *conn) serve() {
+	defer c.c.Close()
+
+	c.writef("* OK [CAPABILITY %s] temp-email IMAP4rev1 ready", c.capabilities())
+	c.w.Flush()
+
+	for {
+		c.c.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		line, err := readCommand(c.r, func() error {
+			c.writef("+ Ready for literal data")
+			return c.w.Flush()
+		})
+		if err == errLineTooLong {
+			c.writef("* BAD Line too long")
+			c.w.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					c.writef("* BYE Idle for too long")
+					c.w.Flush()
+				}
+			}
+			return
+		}
+
+		cmd, err := parseCommand(line)
+		if err != nil {
+			tag := cmd.Tag
+			if tag == "" {
+				tag = "*"
+			}
+			c.writef("%s BAD %s", tag, err)
+			c.w.Flush()
+			continue
+		}
+
+		err = c.run(cmd)
+		if err == errLogout {
+			c.writef("* BYE Logging out")
+			c.writef("%s OK LOGOUT completed", cmd.Tag)
+			c.w.Flush()
+			return
+		}
+
+		var status *statusError
+		if errors.As(err, &status) {
+			c.writef("%s %s %s", cmd.Tag, status.Status, status.Text)
+		} else if err != nil {
+			log.Println(err)
+			c.writef("%s NO Something went wrong, try again later", cmd.Tag)
+		}
+
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) writef(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format, args...)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) ok(cmd command, text string) {
+	c.writef("%s OK %s", cmd.Tag, text)
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) capabilities() string {
+	caps := "IMAP4rev1 LITERAL+ ID UNSELECT"
+
+	// App passwords never go over the wire unencrypted
+	if c.isTLS() {
+		caps += " AUTH=PLAIN"
+	} else {
+		caps += " LOGINDISABLED"
+		if c.server.TLSConfig != nil {
+			caps += " STARTTLS"
+		}
+	}
+
+	return caps
+}
+
+func (c *conn) run(cmd command) error {
+	// Commands that work in any state
+	switch cmd.Name {
+	case "CAPABILITY":
+		c.writef("* CAPABILITY %s", c.capabilities())
+		c.ok(cmd, "CAPABILITY completed")
+		return nil
+	case "NOOP", "CHECK":
+		if c.selected {
+			if err := c.refresh(); err != nil {
+				return err
+			}
+		}
+		c.ok(cmd, cmd.Name+" completed")
+		return nil
+	case "LOGOUT":
+		return errLogout
+	case "ID":
+		c.writef(`* ID ("name" "temp-email")`)
+		c.ok(cmd, "ID completed")
+		return nil
+	}
+
+	if c.address == nil {
+		switch cmd.Name {
+		case "STARTTLS":
+			return c.startTLS(cmd)
+		case "LOGIN", "AUTHENTICATE":
+			if !c.isTLS() {
+				return no("[PRIVACYREQUIRED] Use STARTTLS or the TLS port to log in")
+			}
+			if cmd.Name == "LOGIN" {
+				return c.login(cmd)
+			}
+			return c.authenticate(cmd)
+		}
+		return bad("Log in first")
+	}
+
+	switch cmd.Name {
+	case "SELECT", "EXAMINE":
+		return c.selectInbox(cmd)
+	case "LIST", "LSUB":
+		return c.list(cmd)
+	case "STATUS":
+		return c.status(cmd)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		c.ok(cmd, cmd.Name+" completed")
+		return nil
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		return no("This server is read-only")
+	case "LOGIN", "AUTHENTICATE", "STARTTLS":
+		return bad("Already logged in")
+	}
+
+	if !c.selected {
+		return bad("Unknown command or no mailbox selected")
+	}
+
+	uid := false
+	if cmd.Name == "UID" {
+		if len(cmd.Args) == 0 {
+			return bad("Missing command")
+		}
+		name, _ := asString(cmd.Args[0])
+		cmd.Name = strings.ToUpper(name)
+		cmd.Args = cmd.Args[1:]
+		uid = true
+	}
+
+	switch cmd.Name {
+	case "FETCH":
+		return c.fetch(cmd, uid)
+	case "SEARCH":
+		return c.search(cmd, uid)
+	case "STORE":
+		return c.store(cmd, uid)
+	case "COPY", "MOVE":
+		return no("This server is read-only")
+	case "CLOSE", "UNSELECT":
+		if uid {
+			break
+		}
+		c.selected = false
+		c.messages = nil
+		c.parsed = nil
+		c.ok(cmd, cmd.Name+" completed")
+		return nil
+	case "EXPUNGE":
+		if uid {
+			break
+		}
+		// Nothing can be deleted over IMAP, so there's nothing to expunge
+		c.ok(cmd, "EXPUNGE completed")
+		return nil
+	}
+
+	return bad("Unknown command")
+}
+
+func (c *conn) startTLS(cmd command) error {
+	if c.server.TLSConfig == nil || c.isTLS() {
+		return bad("STARTTLS not available")
+	}
+
+	c.ok(cmd, "Begin TLS negotiation now")
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(c.c, c.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	c.c = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	c.w = bufio.NewWriter(tlsConn)
+	return nil
+}
+
+func (c *conn) login(cmd command) error {
+	if len(cmd.Args) != 2 {
+		return bad("Expected a username and password")
+	}
+	username, ok1 := asString(cmd.Args[0])
+	password, ok2 := asString(cmd.Args[1])
+	if !ok1 || !ok2 {
+		return bad("Expected a username and password")
+	}
+
+	return c.finishLogin(cmd, username, password)
+}
+
+func (c *conn) authenticate(cmd command) error {
+	if len(cmd.Args) == 0 {
+		return bad("Missing mechanism")
+	}
+	mechanism, _ := asString(cmd.Args[0])
+	if !strings.EqualFold(mechanism, "PLAIN") {
+		return no("Unsupported authentication mechanism")
+	}
+
+	c.writef("+ ")
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	line, err := readLine(c.r)
+	if err != nil {
+		return err
+	}
+	if line == "*" {
+		return bad("Authentication cancelled")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return bad("Invalid base64")
+	}
+
+	// authzid, authcid and password, separated by NULs
+	fields := strings.Split(string(decoded), "\x00")
+	if len(fields) != 3 {
+		return bad("Invalid PLAIN response")
+	}
+
+	return c.finishLogin(cmd, fields[1], fields[2])
+}
+
+func (c *conn) finishLogin(cmd command, username, password string) error {
+	address, err := mailbox.Authenticate(username, password)
+	if err == mailbox.ErrInvalidCredentials {
+		// Slow down anyone guessing passwords
+		time.Sleep(time.Second)
+		return no("[AUTHENTICATIONFAILED] Invalid credentials")
+	} else if err != nil {
+		return err
+	}
+
+	c.address = &address
+	c.ok(cmd, fmt.Sprintf("[CAPABILITY %s] Logged in", c.capabilities()))
+	return nil
+}
+
+// Only INBOX exists, and its name is case-insensitive
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+func (c *conn) selectInbox(cmd command) error {
+	c.selected = false
+	c.messages = nil
+	c.parsed = nil
+
+	if len(cmd.Args) < 1 {
+		return bad("Missing mailbox name")
+	}
+	if name, _ := asString(cmd.Args[0]); !isInbox(name) {
+		return no("[NONEXISTENT] Only INBOX exists")
+	}
+
+	messages, err := mailbox.Messages(*c.address)
+	if err != nil {
+		return err
+	}
+
+	unseen := 0
+	for i, m := range messages {
+		if !m.Seen {
+			unseen = i + 1
+			break
+		}
+	}
+
+	c.selected = true
+	c.readOnly = cmd.Name == "EXAMINE"
+	c.messages = messages
+	c.parsed = map[uint32]*part{}
+
+	c.writef(`* FLAGS (\Seen)`)
+	c.writef("* %d EXISTS", len(messages))
+	c.writef("* 0 RECENT")
+	if unseen > 0 {
+		c.writef("* OK [UNSEEN %d] First unseen message", unseen)
+	}
+	c.writef("* OK [UIDVALIDITY %d] UIDs valid", c.uidValidity())
+	c.writef("* OK [UIDNEXT %d] Predicted next UID", c.uidNext(messages))
+
+	if c.readOnly {
+		c.writef("* OK [PERMANENTFLAGS ()] No permanent flags permitted")
+		c.ok(cmd, "[READ-ONLY] EXAMINE completed")
+	} else {
+		c.writef(`* OK [PERMANENTFLAGS (\Seen)] Only \Seen can be changed`)
+		c.ok(cmd, "[READ-WRITE] SELECT completed")
+	}
+	return nil
+}
+
+// Addresses are never reused, so their creation time works fine here
+func (c *conn) uidValidity() uint32 {
+	return uint32(c.address.CreatedAt.Unix())
+}
+
+func (c *conn) uidNext(messages []db.Email) uint32 {
+	if len(messages) == 0 {
+		return 1
+	}
+	return messages[len(messages)-1].UID + 1
+}
+
+// Lets the client know about emails that arrived, went away or were marked
+// as read since it last looked
+func (c *conn) refresh() error {
+	latest, err := mailbox.Messages(*c.address)
+	if err != nil {
+		return err
+	}
+
+	byUID := map[uint32]db.Email{}
+	for _, m := range latest {
+		byUID[m.UID] = m
+	}
+
+	// Go backwards so the sequence numbers we send stay right
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if _, ok := byUID[c.messages[i].UID]; !ok {
+			c.writef("* %d EXPUNGE", i+1)
+			delete(c.parsed, c.messages[i].UID)
+			c.messages = append(c.messages[:i], c.messages[i+1:]...)
+		}
+	}
+
+	known := map[uint32]bool{}
+	for i, m := range c.messages {
+		known[m.UID] = true
+
+		if updated := byUID[m.UID]; updated.Seen != m.Seen {
+			c.messages[i].Seen = updated.Seen
+			c.writef("* %d FETCH (FLAGS %s)", i+1, flags(c.messages[i]))
+		}
+	}
+
+	count := len(c.messages)
+	for _, m := range latest {
+		if !known[m.UID] {
+			c.messages = append(c.messages, m)
+		}
+	}
+	if len(c.messages) != count {
+		c.writef("* %d EXISTS", len(c.messages))
+	}
+
+	return nil
+}
+
+func (c *conn) list(cmd command) error {
+	if len(cmd.Args) != 2 {
+		return bad("Expected a reference and mailbox name")
+	}
+	reference, _ := asString(cmd.Args[0])
+	pattern, _ := asString(cmd.Args[1])
+
+	if pattern == "" {
+		// Asking for the hierarchy delimiter
+		c.writef(`* %s (\Noselect) "/" ""`, cmd.Name)
+	} else if matchPattern(reference+pattern, "INBOX") {
+		c.writef(`* %s (\HasNoChildren) "/" INBOX`, cmd.Name)
+	}
+
+	c.ok(cmd, cmd.Name+" completed")
+	return nil
+}
+
+// Matches mailbox names against LIST patterns, where * and % are wildcards
+func matchPattern(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+
+	if pattern[0] == '*' || pattern[0] == '%' {
+		for i := 0; i <= len(name); i++ {
+			if matchPattern(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if name == "" {
+		return false
+	}
+	if !strings.EqualFold(pattern[:1], name[:1]) {
+		return false
+	}
+	return matchPattern(pattern[1:], name[1:])
+}
+
+func (c *conn) status(cmd command) error {
+	if len(cmd.Args) != 2 {
+		return bad("Expected a mailbox name and status items")
+	}
+	if name, _ := asString(cmd.Args[0]); !isInbox(name) {
+		return no("[NONEXISTENT] Only INBOX exists")
+	}
+	items, ok := cmd.Args[1].(list)
+	if !ok {
+		return bad("Expected a list of status items")
+	}
+
+	messages, err := mailbox.Messages(*c.address)
+	if err != nil {
+		return err
+	}
+
+	var fields []string
+	for _, item := range items {
+		name, _ := asString(item)
+		name = strings.ToUpper(name)
+
+		switch name {
+		case "MESSAGES":
+			fields = append(fields, fmt.Sprintf("MESSAGES %d", len(messages)))
+		case "RECENT":
+			fields = append(fields, "RECENT 0")
+		case "UIDNEXT":
+			fields = append(fields, fmt.Sprintf("UIDNEXT %d", c.uidNext(messages)))
+		case "UIDVALIDITY":
+			fields = append(fields, fmt.Sprintf("UIDVALIDITY %d", c.uidValidity()))
+		case "UNSEEN":
+			unseen := 0
+			for _, m := range messages {
+				if !m.Seen {
+					unseen++
+				}
+			}
+			fields = append(fields, fmt.Sprintf("UNSEEN %d", unseen))
+		default:
+			return bad("Unknown status item %s", name)
+		}
+	}
+
+	c.writef("* STATUS INBOX (%s)", strings.Join(fields, " "))
+	c.ok(cmd, "STATUS completed")
+	return nil
+}
+
+func flags(m db.Email) string {
+	if m.Seen {
+		return `(\Seen)`
+	}
+	return "()"
+}
+
+// Finds the messages a sequence set refers to, as indexes into c.messages
+func (c *conn) resolve(arg interface{}, uid bool) ([]int, error) {
+	s, ok := arg.(atom)
+	if !ok {
+		return nil, bad("Invalid sequence set")
+	}
+	set, err := parseSeqSet(string(s))
+	if err != nil {
+		return nil, bad("%s", err)
+	}
+
+	var indexes []int
+	if len(c.messages) == 0 {
+		return indexes, nil
+	}
+
+	for i, m := range c.messages {
+		if uid && set.Contains(m.UID, c.messages[len(c.messages)-1].UID) {
+			indexes = append(indexes, i)
+		} else if !uid && set.Contains(uint32(i+1), uint32(len(c.messages))) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if !uid && len(indexes) == 0 {
+		return nil, bad("No messages in that range")
+	}
+	return indexes, nil
+}
+
+// The parsed form of a message, which is kept around since clients tend to
+// fetch different bits of the same message one after another
+func (c *conn) message(i int) *part {
+	m := c.messages[i]
+	if p, ok := c.parsed[m.UID]; ok {
+		return p
+	}
+
+	p := parseMessage(mailbox.Raw(m))
+	c.parsed[m.UID] = p
+	return p
+}
+
+// The whole message as clients see it
+func (p *part) raw() []byte {
+	return append(append([]byte(nil), p.Header...), p.Body...)
+}
+
+func (c *conn) setSeen(indexes []int, seen bool) error {
+	var ids []string
+	for _, i := range indexes {
+		if c.messages[i].Seen != seen {
+			ids = append(ids, c.messages[i].ID)
+		}
+	}
+
+	if err := mailbox.SetSeen(ids, seen); err != nil {
+		return err
+	}
+
+	for _, i := range indexes {
+		c.messages[i].Seen = seen
+	}
+	return nil
+}
+
+func (c *conn) store(cmd command, uid bool) error {
+	if c.readOnly {
+		return no("Mailbox is read-only")
+	}
+	if len(cmd.Args) != 3 {
+		return bad("Expected a sequence set, item and flags")
+	}
+
+	indexes, err := c.resolve(cmd.Args[0], uid)
+	if err != nil {
+		return err
+	}
+
+	item, _ := asString(cmd.Args[1])
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+
+	var flagArgs []interface{}
+	if l, ok := cmd.Args[2].(list); ok {
+		flagArgs = l
+	} else {
+		flagArgs = []interface{}{cmd.Args[2]}
+	}
+
+	hasSeen := false
+	for _, f := range flagArgs {
+		if name, _ := asString(f); strings.EqualFold(name, `\Seen`) {
+			hasSeen = true
+		}
+	}
+
+	// Other flags can't be stored, so they're quietly dropped
+	switch item {
+	case "FLAGS":
+		err = c.setSeen(indexes, hasSeen)
+	case "+FLAGS":
+		if hasSeen {
+			err = c.setSeen(indexes, true)
+		}
+	case "-FLAGS":
+		if hasSeen {
+			err = c.setSeen(indexes, false)
+		}
+	default:
+		return bad("Unknown store item")
+	}
+	if err != nil {
+		return err
+	}
+
+	if !silent {
+		for _, i := range indexes {
+			if uid {
+				c.writef("* %d FETCH (UID %d FLAGS %s)", i+1, c.messages[i].UID, flags(c.messages[i]))
+			} else {
+				c.writef("* %d FETCH (FLAGS %s)", i+1, flags(c.messages[i]))
+			}
+		}
+	}
+
+	c.ok(cmd, "STORE completed")
+	return nil
+}
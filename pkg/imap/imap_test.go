@@ -0,0 +1,171 @@
+package imap
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/internal/mailtest"
+)
+
+// The client end of a session
+type client struct {
+	*mailtest.Client
+}
+
+// Starts a session over a pipe, with the server's connection set up by
+// prepare before it starts talking
+func startSession(t *testing.T, server *Server, prepare func(*conn)) *client {
+	serverConn, cl := mailtest.Pipe(t)
+
+	c := &conn{
+		server: server,
+		c:      serverConn,
+		r:      bufio.NewReader(serverConn),
+		w:      bufio.NewWriter(serverConn),
+	}
+	if prepare != nil {
+		prepare(c)
+	}
+	go c.serve()
+
+	if greeting := cl.ReadLine(); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	return &client{cl}
+}
+
+// Sends a command and returns everything up to and including its tagged
+// response, joined with newlines
+func (cl *client) run(tag, command string) string {
+	cl.T.Helper()
+
+	cl.Write(tag + " " + command + "\r\n")
+
+	var lines []string
+	for {
+		line := cl.ReadLine()
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+func (cl *client) expect(tag, command string, want ...string) string {
+	cl.T.Helper()
+
+	got := cl.run(tag, command)
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			cl.T.Errorf("%s %s: response doesn't contain %q:\n%s", tag, command, w, got)
+		}
+	}
+	return got
+}
+
+func TestPlaintextLoginRefused(t *testing.T) {
+	cl := startSession(t, &Server{TLSConfig: mailtest.TLSConfig(t)}, nil)
+
+	caps := cl.expect("a1", "CAPABILITY", "LOGINDISABLED", "STARTTLS", "a1 OK")
+	if strings.Contains(caps, "AUTH=PLAIN") {
+		t.Errorf("AUTH=PLAIN advertised without TLS:\n%s", caps)
+	}
+
+	cl.expect("a2", "LOGIN someone@example.com password", "a2 NO [PRIVACYREQUIRED]")
+	cl.expect("a3", "AUTHENTICATE PLAIN", "a3 NO [PRIVACYREQUIRED]")
+	cl.expect("a4", "SELECT INBOX", "a4 BAD")
+
+	cl.expect("a5", "STARTTLS", "a5 OK")
+
+	cl.StartTLS()
+
+	caps = cl.expect("a6", "CAPABILITY", "AUTH=PLAIN", "a6 OK")
+	if strings.Contains(caps, "LOGINDISABLED") || strings.Contains(caps, "STARTTLS") {
+		t.Errorf("still advertising plaintext capabilities after STARTTLS:\n%s", caps)
+	}
+
+	cl.expect("a7", "LOGOUT", "* BYE", "a7 OK")
+}
+
+func TestNoLoginWithoutTLS(t *testing.T) {
+	cl := startSession(t, &Server{}, nil)
+
+	caps := cl.expect("a1", "CAPABILITY", "LOGINDISABLED")
+	if strings.Contains(caps, "STARTTLS") {
+		t.Errorf("STARTTLS advertised without a certificate:\n%s", caps)
+	}
+	cl.expect("a2", "STARTTLS", "a2 BAD")
+	cl.expect("a3", `LOGIN "someone" "password"`, "a3 NO")
+}
+
+const plainMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: abc@temp.test\r\n" +
+	"Subject: Confirm your account\r\n" +
+	"Date: Mon, 2 Jan 2023 15:04:05 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"\r\n" +
+	"Your code is 1234\r\n"
+
+func TestSession(t *testing.T) {
+	received := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	cl := startSession(t, &Server{}, func(c *conn) {
+		// Logged in and looking at INBOX, without a database. EXAMINE keeps
+		// everything read-only, so nothing needs saving.
+		c.address = &db.Address{ID: "abc", Domain: "temp.test", CreatedAt: time.Unix(1600000000, 0)}
+		c.selected = true
+		c.readOnly = true
+		c.parsed = map[uint32]*part{}
+		c.messages = []db.Email{
+			{ID: "one", UID: 10, Content: plainMessage, CreatedAt: received},
+			// Stored with bare LFs, which clients should never see
+			{ID: "two", UID: 12, Content: strings.ReplaceAll(multipartMessage, "\r\n", "\n"), CreatedAt: received, Seen: true},
+		}
+	})
+
+	cl.expect("a1", "FETCH 1:* (UID FLAGS)",
+		"* 1 FETCH (UID 10 FLAGS ())",
+		`* 2 FETCH (UID 12 FLAGS (\Seen))`,
+		"a1 OK")
+
+	cl.expect("a2", "UID FETCH 12 (RFC822.SIZE INTERNALDATE)",
+		`* 2 FETCH (UID 12 RFC822.SIZE 217 INTERNALDATE "02-Jan-2023 15:04:05 +0000")`)
+
+	cl.expect("a3", "UID FETCH 10 BODY.PEEK[HEADER.FIELDS (Subject)]",
+		"* 1 FETCH (UID 10 BODY[HEADER.FIELDS (SUBJECT)] {33}",
+		"Subject: Confirm your account")
+
+	cl.expect("a4", "FETCH 1 BODY.PEEK[TEXT]<13.4>",
+		"* 1 FETCH (BODY[TEXT]<13> {4}",
+		"1234)")
+
+	cl.expect("a5", "FETCH 1 ENVELOPE",
+		`ENVELOPE ("Mon, 2 Jan 2023 15:04:05 +0000" "Confirm your account" (("Alice" NIL "alice" "example.com"))`)
+
+	cl.expect("a6", "SEARCH UNSEEN", "* SEARCH 1\n")
+	cl.expect("a7", "UID SEARCH OR SUBJECT confirm BODY inner", "* SEARCH 10 12\n")
+	cl.expect("a8", "SEARCH NOT SEEN TEXT 1234", "* SEARCH 1\n")
+	cl.expect("a9", "SEARCH SENTON 2-Jan-2023 SMALLER 100", "* SEARCH\n")
+
+	cl.expect("b1", `STORE 1 +FLAGS (\Seen)`, "b1 NO")
+	cl.expect("b2", "COPY 1 Archive", "b2 NO")
+	cl.expect("b3", "FETCH 3 FLAGS", "b3 BAD")
+	cl.expect("b4", `LIST "" *`, `* LIST (\HasNoChildren) "/" INBOX`)
+	cl.expect("b5", "FETCH 1 (BODY[1]", "b5 BAD")
+	cl.expect("b6", "CLOSE", "b6 OK")
+	cl.expect("b7", "FETCH 1 FLAGS", "b7 BAD")
+	cl.expect("b8", "LOGOUT", "* BYE", "b8 OK")
+}
+
+func TestOversizedCommand(t *testing.T) {
+	cl := startSession(t, &Server{}, nil)
+
+	cl.Write("a1 LOGIN {70000+}\r\n")
+
+	if line := cl.ReadLine(); line != "* BAD Line too long" {
+		t.Errorf("got %q", line)
+	}
+}
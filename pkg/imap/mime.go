@@ -0,0 +1,341 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// How deeply multiparts and attached messages are followed
+const maxPartDepth = 20
+
+// A MIME entity: the message itself, one of its parts, or a message attached
+// to it
+type part struct {
+	// Header includes the blank line after it
+	Header []byte
+	Body   []byte
+	Fields []headerField
+
+	Type    string
+	Subtype string
+	Params  map[string]string
+
+	// Set for multiparts and message/rfc822 parts respectively
+	Parts   []*part
+	Message *part
+}
+
+type headerField struct {
+	Name string
+	// The whole field as it was sent, including folding and the final CRLF
+	Raw []byte
+}
+
+// Value is the field's value with any folding undone
+func (f headerField) Value() string {
+	value := f.Raw[len(f.Name)+1:]
+	value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+	return strings.TrimSpace(string(value))
+}
+
+func parseMessage(raw []byte) *part {
+	return parsePart(raw, 0)
+}
+
+func parsePart(raw []byte, depth int) *part {
+	p := &part{}
+
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		p.Header = raw[:2]
+		p.Body = raw[2:]
+	} else if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		p.Header = raw[:i+4]
+		p.Body = raw[i+4:]
+	} else {
+		p.Header = raw
+	}
+	p.Fields = splitFields(p.Header)
+
+	p.Type, p.Subtype = "text", "plain"
+	p.Params = map[string]string{"charset": "us-ascii"}
+	if mediaType, params, err := mime.ParseMediaType(p.Get("Content-Type")); err == nil {
+		split := strings.SplitN(mediaType, "/", 2)
+		if len(split) == 2 {
+			p.Type, p.Subtype, p.Params = split[0], split[1], params
+		}
+	}
+
+	if depth >= maxPartDepth {
+		return p
+	}
+
+	if p.Type == "multipart" && p.Params["boundary"] != "" {
+		for _, raw := range splitMultipart(p.Body, p.Params["boundary"]) {
+			p.Parts = append(p.Parts, parsePart(raw, depth+1))
+		}
+	} else if p.Type == "message" && p.Subtype == "rfc822" {
+		p.Message = parsePart(p.Body, depth+1)
+	}
+
+	return p
+}
+
+func splitFields(header []byte) []headerField {
+	var fields []headerField
+
+	for len(header) > 0 {
+		end := bytes.Index(header, []byte("\r\n"))
+		if end < 0 {
+			end = len(header)
+		} else {
+			end += 2
+		}
+		line := header[:end]
+		header = header[end:]
+
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if len(fields) > 0 {
+				fields[len(fields)-1].Raw = append(fields[len(fields)-1].Raw, line...)
+			}
+			continue
+		}
+
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		fields = append(fields, headerField{
+			Name: string(line[:colon]),
+			Raw:  append([]byte(nil), line...),
+		})
+	}
+
+	return fields
+}
+
+// Get returns the first value of a header field
+func (p *part) Get(name string) string {
+	for _, f := range p.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// The header with only (or without) the given fields
+func (p *part) filterHeader(names []string, not bool) []byte {
+	var b bytes.Buffer
+
+	for _, f := range p.Fields {
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(f.Name, name) {
+				found = true
+				break
+			}
+		}
+
+		if found != not {
+			b.Write(f.Raw)
+		}
+	}
+
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func splitMultipart(body []byte, boundary string) [][]byte {
+	var parts [][]byte
+	delimiter := []byte("--" + boundary)
+	start := -1
+
+	for i := 0; i <= len(body); {
+		end := bytes.Index(body[i:], []byte("\r\n"))
+		if end < 0 {
+			end = len(body)
+		} else {
+			end += i
+		}
+
+		line := bytes.TrimRight(body[i:end], " \t")
+		if bytes.HasPrefix(line, delimiter) {
+			rest := string(line[len(delimiter):])
+
+			if rest == "" || rest == "--" {
+				// The CRLF before a delimiter belongs to the delimiter
+				if start >= 0 {
+					partEnd := i - 2
+					if partEnd < start {
+						partEnd = start
+					}
+					parts = append(parts, body[start:partEnd])
+				}
+				if rest == "--" {
+					return parts
+				}
+				start = end + 2
+			}
+		}
+
+		i = end + 2
+	}
+
+	// Missing the closing delimiter
+	if start >= 0 && start <= len(body) {
+		parts = append(parts, body[start:])
+	}
+
+	return parts
+}
+
+// How many lines a part's body has
+func countLines(body []byte) int {
+	n := bytes.Count(body, []byte("\r\n"))
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\r\n")) {
+		n++
+	}
+	return n
+}
+
+// Formats the BODY or BODYSTRUCTURE of a part
+func (p *part) structure(extended bool) string {
+	if len(p.Parts) > 0 {
+		var b strings.Builder
+		b.WriteString("(")
+		for _, child := range p.Parts {
+			b.WriteString(child.structure(extended))
+		}
+		b.WriteString(" " + quote(strings.ToUpper(p.Subtype)))
+
+		if extended {
+			b.WriteString(" " + formatParams(p.Params) + " " + p.disposition() + " NIL NIL")
+		}
+
+		b.WriteString(")")
+		return b.String()
+	}
+
+	encoding := strings.ToUpper(p.Get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+
+	fields := []string{
+		quote(strings.ToUpper(p.Type)),
+		quote(strings.ToUpper(p.Subtype)),
+		formatParams(p.Params),
+		nstring(p.Get("Content-ID")),
+		nstring(p.Get("Content-Description")),
+		quote(encoding),
+		fmt.Sprint(len(p.Body)),
+	}
+
+	if p.Message != nil {
+		fields = append(fields, p.Message.envelope(), p.Message.structure(extended), fmt.Sprint(countLines(p.Body)))
+	} else if p.Type == "text" {
+		fields = append(fields, fmt.Sprint(countLines(p.Body)))
+	}
+
+	if extended {
+		fields = append(fields, "NIL", p.disposition(), "NIL", "NIL")
+	}
+
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func (p *part) disposition() string {
+	disposition, params, err := mime.ParseMediaType(p.Get("Content-Disposition"))
+	if err != nil {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)", quote(strings.ToUpper(disposition)), formatParams(params))
+}
+
+func formatParams(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	for _, key := range keys {
+		fields = append(fields, quote(strings.ToUpper(key)), quote(params[key]))
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func (p *part) envelope() string {
+	from := p.addresses("From")
+	sender := p.addresses("Sender")
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := p.addresses("Reply-To")
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+
+	return "(" + strings.Join([]string{
+		nstring(p.Get("Date")),
+		nstring(p.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		p.addresses("To"),
+		p.addresses("Cc"),
+		p.addresses("Bcc"),
+		nstring(p.Get("In-Reply-To")),
+		nstring(p.Get("Message-ID")),
+	}, " ") + ")"
+}
+
+func (p *part) addresses(field string) string {
+	list, err := mail.ParseAddressList(p.Get(field))
+	if err != nil || len(list) == 0 {
+		return "NIL"
+	}
+
+	var b strings.Builder
+	b.WriteString("(")
+	for _, address := range list {
+		local, host := address.Address, ""
+		if i := strings.LastIndex(local, "@"); i >= 0 {
+			local, host = local[:i], local[i+1:]
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(address.Name), nstring(local), nstring(host))
+	}
+	b.WriteString(")")
+
+	return b.String()
+}
+
+// Formats a string, using a literal if it can't be quoted
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// Like quote, but empty strings are NIL
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
@@ -0,0 +1,334 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on what clients can send, since nothing we support needs much.
+// maxLineLength applies to a whole command, literals included.
+const (
+	maxLineLength = 64 << 10
+	maxLiterals   = 16
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// An atom, e.g. a command name, flag or sequence set
+type atom string
+
+// A quoted string or a literal
+type str string
+
+// A parenthesized list of other arguments
+type list []interface{}
+
+type command struct {
+	Tag  string
+	Name string
+	Args []interface{}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// Reads a whole command, including any literals it contains. Literals are
+// kept inline as "{n}\r\n" followed by their contents, for parseCommand to pick
+// up. continueLiteral is called before synchronizing literals are read.
+func readCommand(r *bufio.Reader, continueLiteral func() error) (string, error) {
+	var b strings.Builder
+
+	for literals := 0; ; literals++ {
+		line, err := readLine(r)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(line)
+		if b.Len() > maxLineLength {
+			return "", errLineTooLong
+		}
+
+		n, sync, ok := literalSuffix(line)
+		if !ok {
+			return b.String(), nil
+		}
+		if literals >= maxLiterals || b.Len()+n > maxLineLength {
+			return "", errLineTooLong
+		}
+
+		if sync {
+			if err := continueLiteral(); err != nil {
+				return "", err
+			}
+		}
+
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(r, literal); err != nil {
+			return "", err
+		}
+		b.WriteString("\r\n")
+		b.Write(literal)
+	}
+}
+
+// Checks whether a line ends with a literal, like "{12}" or "{12+}"
+func literalSuffix(line string) (int, bool, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	start := strings.LastIndex(line, "{")
+	if start < 0 {
+		return 0, false, false
+	}
+
+	inner := line[start+1 : len(line)-1]
+	sync := true
+	if strings.HasSuffix(inner, "+") {
+		sync = false
+		inner = inner[:len(inner)-1]
+	}
+
+	n, err := strconv.Atoi(inner)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+func parseCommand(line string) (command, error) {
+	var cmd command
+
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || fields[0] == "" {
+		return cmd, errors.New("missing tag or command")
+	}
+
+	cmd.Tag = fields[0]
+	cmd.Name = strings.ToUpper(fields[1])
+
+	if len(fields) == 3 {
+		p := &parser{s: fields[2]}
+		args, err := p.parseList(false)
+		if err != nil {
+			return cmd, err
+		}
+		cmd.Args = args
+	}
+
+	return cmd, nil
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+// Parses arguments until the end of the input, or until the closing
+// parenthesis if nested
+func (p *parser) parseList(nested bool) ([]interface{}, error) {
+	args := []interface{}{}
+
+	for {
+		for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+			p.pos++
+		}
+
+		if p.pos >= len(p.s) {
+			if nested {
+				return nil, errors.New("unclosed parenthesis")
+			}
+			return args, nil
+		}
+
+		switch c := p.s[p.pos]; {
+		case c == ')':
+			if !nested {
+				return nil, errors.New("unexpected )")
+			}
+			p.pos++
+			return args, nil
+		case c == '(':
+			p.pos++
+			inner, err := p.parseList(true)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, list(inner))
+		case c == '"':
+			s, err := p.parseQuoted()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+		case c == '{':
+			s, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+		default:
+			args = append(args, p.parseAtom())
+		}
+	}
+}
+
+func (p *parser) parseQuoted() (str, error) {
+	var b strings.Builder
+	p.pos++
+
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+
+		switch c {
+		case '\\':
+			if p.pos >= len(p.s) {
+				return "", errors.New("unterminated string")
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case '"':
+			return str(b.String()), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", errors.New("unterminated string")
+}
+
+func (p *parser) parseLiteral() (str, error) {
+	end := strings.Index(p.s[p.pos:], "}\r\n")
+	if end < 0 {
+		return "", errors.New("invalid literal")
+	}
+
+	n, err := strconv.Atoi(strings.TrimSuffix(p.s[p.pos+1:p.pos+end], "+"))
+	if err != nil || n < 0 {
+		return "", errors.New("invalid literal")
+	}
+
+	start := p.pos + end + 3
+	if start+n > len(p.s) {
+		return "", errors.New("truncated literal")
+	}
+
+	p.pos = start + n
+	return str(p.s[start:p.pos]), nil
+}
+
+// Atoms run until a space or parenthesis, except inside brackets, so that
+// things like BODY[HEADER.FIELDS (From To)]<0.100> stay in one piece
+func (p *parser) parseAtom() atom {
+	start := p.pos
+	depth := 0
+
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+			break
+		}
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		}
+		p.pos++
+	}
+
+	return atom(p.s[start:p.pos])
+}
+
+// Returns an argument as a string, whether it was an atom, quoted or a
+// literal
+func asString(arg interface{}) (string, bool) {
+	switch v := arg.(type) {
+	case atom:
+		return string(v), true
+	case str:
+		return string(v), true
+	}
+	return "", false
+}
+
+// A set of message numbers like "1:4,7,9:*"
+type seqSet []seqRange
+
+// Zero stands for "*", the largest number in use
+type seqRange struct {
+	Start, Stop uint32
+}
+
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+
+		start, err := parseSeqNumber(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = parseSeqNumber(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		set = append(set, seqRange{Start: start, Stop: stop})
+	}
+
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// Whether n is in the set, where max is what "*" means
+func (set seqSet) Contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.Start, r.Stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+
+		if n >= start && n <= stop {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      string
+		continues int
+		err       error
+	}{
+		{"plain", "a1 NOOP\r\n", "a1 NOOP", 0, nil},
+		{"synchronizing literal", "a1 LOGIN {3}\r\nabc pw\r\n", "a1 LOGIN {3}\r\nabc pw", 1, nil},
+		{"non-synchronizing literal", "a1 LOGIN {3+}\r\nabc {2+}\r\npw\r\n", "a1 LOGIN {3+}\r\nabc {2+}\r\npw", 0, nil},
+		{"literal with CRLF inside", "a1 X {4}\r\na\r\nb\r\n", "a1 X {4}\r\na\r\nb", 1, nil},
+		{"literal too big", "a1 X {70000+}\r\n", "", 0, errLineTooLong},
+		{"literals add up", "a1 X" + strings.Repeat(" {40000+}\r\n"+strings.Repeat("x", 40000), 2) + "\r\n", "", 0, errLineTooLong},
+		{"too many literals", "a1 X" + strings.Repeat(" {1+}\r\nx", maxLiterals+1) + "\r\n", "", 0, errLineTooLong},
+		{"line too long", "a1 " + strings.Repeat("x", maxLineLength) + "\r\n", "", 0, errLineTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			continues := 0
+			got, err := readCommand(bufio.NewReader(strings.NewReader(test.input)), func() error {
+				continues++
+				return nil
+			})
+
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if continues != test.continues {
+				t.Errorf("asked for %d continuations, want %d", continues, test.continues)
+			}
+		})
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	cmd, err := parseCommand(`a1 uid fetch 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (From To)]<0.100>) "quoted \"x\"" {3}` + "\r\nlit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := command{
+		Tag:  "a1",
+		Name: "UID",
+		Args: []interface{}{
+			atom("fetch"),
+			atom("1:*"),
+			list{atom("FLAGS"), atom("BODY.PEEK[HEADER.FIELDS (From To)]<0.100>")},
+			str(`quoted "x"`),
+			str("lit"),
+		},
+	}
+	if !reflect.DeepEqual(cmd, want) {
+		t.Errorf("got %#v\nwant %#v", cmd, want)
+	}
+
+	for _, bad := range []string{"a1", "a1 X (unclosed", "a1 X )", `a1 X "unterminated`, "a1 X {10}\r\nshort"} {
+		if _, err := parseCommand(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	tests := []struct {
+		set  string
+		max  uint32
+		want []uint32
+	}{
+		{"1", 5, []uint32{1}},
+		{"2:4", 5, []uint32{2, 3, 4}},
+		{"4:2", 5, []uint32{2, 3, 4}},
+		{"*", 5, []uint32{5}},
+		{"3:*", 5, []uint32{3, 4, 5}},
+		{"1,3,5:*", 5, []uint32{1, 3, 5}},
+		// "*" is the largest number in use, even if that's below the start
+		{"7:*", 5, []uint32{5}},
+	}
+
+	for _, test := range tests {
+		set, err := parseSeqSet(test.set)
+		if err != nil {
+			t.Fatalf("%s: %v", test.set, err)
+		}
+
+		var got []uint32
+		for n := uint32(1); n <= test.max; n++ {
+			if set.Contains(n, test.max) {
+				got = append(got, n)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s with max %d: got %v, want %v", test.set, test.max, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "0", "a", "1:", "1,,2", "-1"} {
+		if _, err := parseSeqSet(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
+
+func TestParseFetchItem(t *testing.T) {
+	tests := []struct {
+		item string
+		want fetchItem
+	}{
+		{"uid", fetchItem{Name: "UID"}},
+		{"BODY", fetchItem{Name: "BODY"}},
+		{"BODY[]", fetchItem{Name: "BODY", HasSection: true}},
+		{"BODY[1.2.MIME]", fetchItem{Name: "BODY", HasSection: true, Section: "1.2.MIME"}},
+		{"body.peek[header.fields (From To)]<0.100>", fetchItem{Name: "BODY", HasSection: true, Section: "HEADER.FIELDS (FROM TO)", Peek: true, Partial: true, Start: 0, Count: 100}},
+	}
+
+	for _, test := range tests {
+		got, err := parseFetchItem(test.item)
+		if err != nil {
+			t.Errorf("%s: %v", test.item, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.item, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"BODY[", "BODY[]<1>", "BODY[]<1.0>", "BODY[]<a.b>", "NOPE"} {
+		if _, err := parseFetchItem(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
+
+const multipartMessage = "From: Bob <bob@example.com>\r\n" +
+	"Subject: Hi\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Inner\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--outer--\r\n"
+
+func TestSection(t *testing.T) {
+	p := parseMessage([]byte(multipartMessage))
+
+	tests := []struct {
+		section string
+		want    string
+	}{
+		{"", multipartMessage},
+		{"HEADER.FIELDS (SUBJECT)", "Subject: Hi\r\n\r\n"},
+		{"HEADER.FIELDS.NOT (SUBJECT CONTENT-TYPE)", "From: Bob <bob@example.com>\r\n\r\n"},
+		{"1", "hello"},
+		{"1.MIME", "Content-Type: text/plain\r\n\r\n"},
+		{"2.HEADER", "Subject: Inner\r\n\r\n"},
+		{"2.TEXT", "inner body"},
+		{"2.1", "inner body"},
+	}
+
+	for _, test := range tests {
+		got, err := p.section(test.section)
+		if err != nil {
+			t.Errorf("%s: %v", test.section, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.section, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"3", "1.HEADER", "MIME", "BOGUS"} {
+		if _, err := p.section(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestStructure(t *testing.T) {
+	p := parseMessage([]byte(multipartMessage))
+
+	want := fmt.Sprintf(`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 5 1)("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 28 %s ("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 10 1) 3) "MIXED")`,
+		`(NIL "Inner" NIL NIL NIL NIL NIL NIL NIL NIL)`)
+	if got := p.structure(false); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reports whether the message at an index into c.messages matches
+type matcher func(i int) bool
+
+var headerDecoder = &mime.WordDecoder{}
+
+func (c *conn) search(cmd command, uid bool) error {
+	args := cmd.Args
+
+	if len(args) >= 2 {
+		if name, _ := asString(args[0]); strings.EqualFold(name, "CHARSET") {
+			charset, _ := asString(args[1])
+			if !strings.EqualFold(charset, "UTF-8") && !strings.EqualFold(charset, "US-ASCII") {
+				return no("[BADCHARSET (UTF-8 US-ASCII)] Unsupported charset")
+			}
+			args = args[2:]
+		}
+	}
+	if len(args) == 0 {
+		return bad("Missing search criteria")
+	}
+
+	match, err := c.parseSearch(args)
+	if err != nil {
+		return err
+	}
+
+	var results []string
+	for i, m := range c.messages {
+		if !match(i) {
+			continue
+		}
+
+		if uid {
+			results = append(results, fmt.Sprint(m.UID))
+		} else {
+			results = append(results, fmt.Sprint(i+1))
+		}
+	}
+
+	if len(results) == 0 {
+		c.writef("* SEARCH")
+	} else {
+		c.writef("* SEARCH %s", strings.Join(results, " "))
+	}
+	c.ok(cmd, "SEARCH completed")
+	return nil
+}
+
+// Parses a list of search keys, all of which have to match
+func (c *conn) parseSearch(args []interface{}) (matcher, error) {
+	var matchers []matcher
+
+	for len(args) > 0 {
+		m, rest, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		args = rest
+	}
+
+	return func(i int) bool {
+		for _, m := range matchers {
+			if !m(i) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Parses one search key off the front of args
+func (c *conn) parseSearchKey(args []interface{}) (matcher, []interface{}, error) {
+	if l, ok := args[0].(list); ok {
+		m, err := c.parseSearch(l)
+		return m, args[1:], err
+	}
+
+	key, ok := args[0].(atom)
+	if !ok {
+		return nil, nil, bad("Invalid search key")
+	}
+	args = args[1:]
+
+	// Reads the string argument that comes after a key
+	next := func() (string, error) {
+		if len(args) == 0 {
+			return "", bad("Missing argument to %s", key)
+		}
+		s, ok := asString(args[0])
+		if !ok {
+			return "", bad("Invalid argument to %s", key)
+		}
+		args = args[1:]
+		return s, nil
+	}
+
+	always := func(int) bool { return true }
+	never := func(int) bool { return false }
+
+	switch name := strings.ToUpper(string(key)); name {
+	case "ALL", "OLD", "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED":
+		return always, args, nil
+	case "NEW", "RECENT", "ANSWERED", "DELETED", "DRAFT", "FLAGGED":
+		return never, args, nil
+	case "KEYWORD", "UNKEYWORD":
+		if _, err := next(); err != nil {
+			return nil, nil, err
+		}
+		if name == "KEYWORD" {
+			return never, args, nil
+		}
+		return always, args, nil
+	case "SEEN":
+		return func(i int) bool { return c.messages[i].Seen }, args, nil
+	case "UNSEEN":
+		return func(i int) bool { return !c.messages[i].Seen }, args, nil
+	case "BCC", "CC", "FROM", "TO", "SUBJECT":
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.headerContains(name, value), args, nil
+	case "HEADER":
+		field, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.headerContains(field, value), args, nil
+	case "BODY", "TEXT":
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		needle := bytes.ToLower([]byte(value))
+		return func(i int) bool {
+			p := c.message(i)
+			if name == "BODY" {
+				return bytes.Contains(bytes.ToLower(p.Body), needle)
+			}
+			return bytes.Contains(bytes.ToLower(p.raw()), needle)
+		}, args, nil
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		date, err := time.Parse("2-Jan-2006", value)
+		if err != nil {
+			return nil, nil, bad("Invalid date %s", value)
+		}
+
+		return func(i int) bool {
+			t := c.messages[i].CreatedAt
+			if strings.HasPrefix(name, "SENT") {
+				var err error
+				if t, err = mail.ParseDate(c.message(i).Get("Date")); err != nil {
+					return false
+				}
+			}
+
+			// Only the date counts, not the time
+			y, m, d := t.Date()
+			day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+			switch strings.TrimPrefix(name, "SENT") {
+			case "BEFORE":
+				return day.Before(date)
+			case "ON":
+				return day.Equal(date)
+			default:
+				return !day.Before(date)
+			}
+		}, args, nil
+	case "LARGER", "SMALLER":
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, nil, bad("Invalid size %s", value)
+		}
+
+		return func(i int) bool {
+			size := len(c.message(i).raw())
+			if name == "LARGER" {
+				return size > n
+			}
+			return size < n
+		}, args, nil
+	case "UID":
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		set, err := parseSeqSet(value)
+		if err != nil {
+			return nil, nil, bad("%s", err)
+		}
+
+		return func(i int) bool {
+			return set.Contains(c.messages[i].UID, c.messages[len(c.messages)-1].UID)
+		}, args, nil
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, bad("Missing argument to NOT")
+		}
+		m, rest, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int) bool { return !m(i) }, rest, nil
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, bad("Missing arguments to OR")
+		}
+		a, rest, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, bad("Missing arguments to OR")
+		}
+		b, rest, err := c.parseSearchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int) bool { return a(i) || b(i) }, rest, nil
+	default:
+		set, err := parseSeqSet(string(key))
+		if err != nil {
+			return nil, nil, bad("Unknown search key %s", key)
+		}
+
+		return func(i int) bool {
+			return set.Contains(uint32(i+1), uint32(len(c.messages)))
+		}, args, nil
+	}
+}
+
+// Matches messages with a header field containing value, ignoring case. An
+// empty value matches any message that has the field.
+func (c *conn) headerContains(field, value string) matcher {
+	value = strings.ToLower(value)
+
+	return func(i int) bool {
+		for _, f := range c.message(i).Fields {
+			if !strings.EqualFold(f.Name, field) {
+				continue
+			}
+
+			decoded, err := headerDecoder.DecodeHeader(f.Value())
+			if err != nil {
+				decoded = f.Value()
+			}
+			if strings.Contains(strings.ToLower(decoded), value) {
+				return true
+			}
+		}
+		return false
+	}
+}
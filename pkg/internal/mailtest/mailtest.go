@@ -0,0 +1,93 @@
+// Package mailtest has the pieces the IMAP and POP3 tests share: a
+// throwaway certificate and the client end of a session over a pipe
+package mailtest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long the client waits on the server before failing the test
+const timeout = 5 * time.Second
+
+// TLSConfig returns a server config with a self-signed certificate for
+// localhost
+func TLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Client is the client end of a session
+type Client struct {
+	T    *testing.T
+	Conn net.Conn
+	R    *bufio.Reader
+}
+
+// Pipe connects a client to the returned server end, which is closed along
+// with the client when the test is done
+func Pipe(t *testing.T) (net.Conn, *Client) {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+
+	return serverConn, &Client{T: t, Conn: clientConn, R: bufio.NewReader(clientConn)}
+}
+
+// ReadLine reads a line from the server, without the CRLF
+func (cl *Client) ReadLine() string {
+	cl.T.Helper()
+
+	cl.Conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := cl.R.ReadString('\n')
+	if err != nil {
+		cl.T.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// Write sends s to the server as is
+func (cl *Client) Write(s string) {
+	cl.T.Helper()
+
+	cl.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := cl.Conn.Write([]byte(s)); err != nil {
+		cl.T.Fatal(err)
+	}
+}
+
+// StartTLS switches to TLS, once the server has agreed to
+func (cl *Client) StartTLS() {
+	cl.T.Helper()
+
+	tlsConn := tls.Client(cl.Conn, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		cl.T.Fatal(err)
+	}
+	cl.Conn, cl.R = tlsConn, bufio.NewReader(tlsConn)
+}
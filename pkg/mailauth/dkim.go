@@ -0,0 +1,340 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Only the first few signatures on a message are checked
+const maxDKIMSignatures = 5
+
+// Shorter RSA keys can be factored, so signatures made with them prove nothing
+const minRSABits = 1024
+
+var (
+	whitespace   = regexp.MustCompile(`[ \t]+`)
+	signatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+// A single header field, including any folded continuation lines and the
+// trailing CRLF
+type headerField struct {
+	name string
+	raw  string
+}
+
+// Splits a raw message into its header fields and body, normalizing bare
+// LFs to CRLF along the way
+func splitMessage(raw []byte) ([]headerField, []byte) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+
+	var fields []headerField
+
+	for len(raw) > 0 {
+		if bytes.HasPrefix(raw, []byte("\r\n")) {
+			return fields, raw[2:]
+		}
+
+		end := bytes.Index(raw, []byte("\r\n"))
+		if end < 0 {
+			end = len(raw)
+		} else {
+			end += 2
+		}
+		line := string(raw[:end])
+		raw = raw[end:]
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+
+		name := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+
+	return fields, nil
+}
+
+func headerValue(field headerField) string {
+	i := strings.Index(field.raw, ":")
+	if i < 0 {
+		return ""
+	}
+	return field.raw[i+1:]
+}
+
+func parseTags(value string) map[string]string {
+	tags := map[string]string{}
+
+	for _, tag := range strings.Split(value, ";") {
+		i := strings.Index(tag, "=")
+		if i < 0 {
+			continue
+		}
+		tags[strings.TrimSpace(tag[:i])] = strings.TrimSpace(tag[i+1:])
+	}
+
+	return tags
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func (v *Verifier) checkDKIM(ctx context.Context, header []headerField, body []byte) []DKIMResult {
+	var results []DKIMResult
+
+	for _, field := range header {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) >= maxDKIMSignatures {
+			break
+		}
+
+		results = append(results, v.verifySignature(ctx, field, header, body))
+	}
+
+	return results
+}
+
+func (v *Verifier) verifySignature(ctx context.Context, signature headerField, header []headerField, body []byte) DKIMResult {
+	tags := parseTags(headerValue(signature))
+
+	result := DKIMResult{
+		Domain:   strings.ToLower(tags["d"]),
+		Selector: tags["s"],
+	}
+	fail := func(r Result, reason string) DKIMResult {
+		result.Result = r
+		result.Reason = reason
+		return result
+	}
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return fail(PermError, "missing "+required+"= tag")
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(PermError, "unsupported version")
+	}
+
+	signedHeaders := strings.Split(tags["h"], ":")
+	signsFrom := false
+	for i, h := range signedHeaders {
+		signedHeaders[i] = strings.TrimSpace(h)
+		if strings.EqualFold(signedHeaders[i], "from") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return fail(PermError, "from header not signed")
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err == nil && time.Now().Unix() > expires {
+			return fail(Fail, "signature expired")
+		}
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	keyType := "rsa"
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "rsa-sha1":
+		newHash, cryptoHash = sha1.New, crypto.SHA1
+	case "ed25519-sha256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+		keyType = "ed25519"
+	default:
+		return fail(PermError, "unsupported algorithm")
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		split := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerCanon = split[0]
+		if len(split) == 2 {
+			bodyCanon = split[1]
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return fail(PermError, "unsupported canonicalization")
+	}
+
+	// A body length limit lets anyone append whatever they like after the
+	// signed part, so those signatures don't count
+	if _, ok := tags["l"]; ok {
+		return fail(PermError, "body length limit not accepted")
+	}
+
+	// Body hash
+	bodyHash := newHash()
+	bodyHash.Write(canonicalizeBody(body, bodyCanon))
+
+	expectedBodyHash, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"]))
+	if err != nil {
+		return fail(PermError, "invalid body hash")
+	}
+	if !bytes.Equal(bodyHash.Sum(nil), expectedBodyHash) {
+		return fail(Fail, "body hash did not verify")
+	}
+
+	// Header hash
+	headerHash := newHash()
+	used := map[int]bool{}
+	for _, name := range signedHeaders {
+		// Use the bottom-most instance of each header that hasn't been used yet
+		for i := len(header) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(header[i].name, name) {
+				used[i] = true
+				headerHash.Write([]byte(canonicalizeHeader(header[i].raw, headerCanon)))
+				break
+			}
+		}
+	}
+
+	// The signature field itself is included with an empty b= tag and no
+	// trailing CRLF
+	i := strings.Index(signature.raw, ":")
+	unsigned := signature.raw[:i+1] + signatureTag.ReplaceAllString(signature.raw[i+1:], "$1$2")
+	headerHash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(unsigned, headerCanon), "\r\n")))
+
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return fail(PermError, "invalid signature")
+	}
+
+	// Public key
+	txts, err := v.Resolver.LookupTXT(ctx, result.Selector+"._domainkey."+result.Domain)
+	if err != nil {
+		if isNotFound(err) {
+			return fail(PermError, "no key for signature")
+		}
+		return fail(TempError, "key unavailable")
+	}
+	// Strings within one record are already joined by the resolver, so more
+	// than one here means more than one record, and no way to tell which key
+	// is meant
+	if len(txts) == 0 {
+		return fail(PermError, "no key for signature")
+	}
+	if len(txts) > 1 {
+		return fail(PermError, "multiple key records")
+	}
+	keyTags := parseTags(txts[0])
+
+	if k, ok := keyTags["k"]; ok && !strings.EqualFold(k, keyType) {
+		return fail(PermError, "key type mismatch")
+	}
+	if keyTags["p"] == "" {
+		return fail(Fail, "key revoked")
+	}
+	keyData, err := base64.StdEncoding.DecodeString(stripWhitespace(keyTags["p"]))
+	if err != nil {
+		return fail(PermError, "invalid public key")
+	}
+
+	digest := headerHash.Sum(nil)
+
+	switch keyType {
+	case "rsa":
+		parsed, err := x509.ParsePKIXPublicKey(keyData)
+		if err != nil {
+			// Some keys are published as a bare PKCS#1 RSAPublicKey
+			parsed, err = x509.ParsePKCS1PublicKey(keyData)
+		}
+		key, ok := parsed.(*rsa.PublicKey)
+		if err != nil || !ok {
+			return fail(PermError, "invalid public key")
+		}
+		// RFC 8301 section 3.2
+		if key.N.BitLen() < minRSABits {
+			return fail(PermError, "key too short")
+		}
+
+		if rsa.VerifyPKCS1v15(key, cryptoHash, digest, sig) != nil {
+			return fail(Fail, "signature did not verify")
+		}
+	case "ed25519":
+		if len(keyData) != ed25519.PublicKeySize {
+			return fail(PermError, "invalid public key")
+		}
+
+		if !ed25519.Verify(ed25519.PublicKey(keyData), digest, sig) {
+			return fail(Fail, "signature did not verify")
+		}
+	}
+
+	result.Result = Pass
+	return result
+}
+
+func canonicalizeHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+
+	i := strings.Index(raw, ":")
+	if i < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+
+	value := strings.ReplaceAll(raw[i+1:], "\r\n", "")
+	value = whitespace.ReplaceAllString(value, " ")
+	value = strings.TrimSpace(value)
+
+	return name + ":" + value + "\r\n"
+}
+
+func canonicalizeBody(body []byte, canon string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	if canon == "relaxed" {
+		for i, line := range lines {
+			line = whitespace.ReplaceAllString(line, " ")
+			lines[i] = strings.TrimRight(line, " ")
+		}
+	}
+
+	// Drop trailing empty lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if canon == "simple" {
+			return []byte("\r\n")
+		}
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,110 @@
+package mailauth
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+func fromDomain(header []headerField) string {
+	for _, field := range header {
+		if !strings.EqualFold(field.name, "From") {
+			continue
+		}
+
+		addresses, err := mail.ParseAddressList(strings.TrimSpace(headerValue(field)))
+		if err != nil || len(addresses) == 0 {
+			return ""
+		}
+		return domainOf(addresses[0].Address)
+	}
+
+	return ""
+}
+
+// The registered domain below its public suffix, e.g. example.co.uk for
+// mail.example.co.uk (RFC 7489 section 3.2)
+func organizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		// The domain is a public suffix itself, or not a domain at all
+		return domain
+	}
+	return org
+}
+
+func aligned(domain, from string, strict bool) bool {
+	domain, from = strings.ToLower(domain), strings.ToLower(from)
+	if strict {
+		return domain == from
+	}
+	return organizationalDomain(domain) == organizationalDomain(from)
+}
+
+// Looks up the DMARC record for a domain, falling back to the
+// organizational domain. orgLevel reports whether it came from the fallback.
+func (v *Verifier) dmarcRecord(ctx context.Context, domain string) (tags map[string]string, orgLevel bool, err error) {
+	lookup := func(name string) (map[string]string, error) {
+		txts, err := v.Resolver.LookupTXT(ctx, "_dmarc."+name)
+		if err != nil {
+			if isNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		for _, txt := range txts {
+			if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(txt)), "V=DMARC1") {
+				return parseTags(txt), nil
+			}
+		}
+		return nil, nil
+	}
+
+	tags, err = lookup(domain)
+	if err != nil || tags != nil {
+		return tags, false, err
+	}
+
+	if org := organizationalDomain(domain); org != domain {
+		tags, err = lookup(org)
+		return tags, true, err
+	}
+
+	return nil, false, nil
+}
+
+func (v *Verifier) checkDMARC(ctx context.Context, results *Results) (Result, string) {
+	if results.FromDomain == "" {
+		return None, ""
+	}
+
+	tags, orgLevel, err := v.dmarcRecord(ctx, results.FromDomain)
+	if err != nil {
+		return TempError, ""
+	} else if tags == nil {
+		return None, ""
+	}
+
+	policy := strings.ToLower(tags["p"])
+	if sp, ok := tags["sp"]; ok && orgLevel {
+		policy = strings.ToLower(sp)
+	}
+	switch policy {
+	case "none", "quarantine", "reject":
+	default:
+		return PermError, ""
+	}
+
+	spfAligned := results.SPF == Pass && aligned(results.SPFDomain, results.FromDomain, strings.ToLower(tags["aspf"]) == "s")
+	dkimAligned := results.dkimAligned(strings.ToLower(tags["adkim"]) == "s")
+
+	if spfAligned || dkimAligned {
+		return Pass, policy
+	}
+	return Fail, policy
+}
@@ -0,0 +1,188 @@
+// Package mailauth verifies the authenticity of inbound mail using SPF,
+// DKIM and DMARC.
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	Neutral   Result = "neutral"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Resolver is the subset of *net.Resolver used for verification. It can be
+// swapped out to verify messages without touching the network.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type Verifier struct {
+	Resolver Resolver
+
+	// Hostname is used as the authserv-id in Authentication-Results
+	Hostname string
+}
+
+type DKIMResult struct {
+	Result   Result
+	Domain   string
+	Selector string
+	Reason   string
+}
+
+type Results struct {
+	SPF       Result
+	SPFDomain string
+
+	DKIM []DKIMResult
+
+	DMARC       Result
+	DMARCPolicy string
+	FromDomain  string
+
+	hostname string
+}
+
+// Verify runs every check against a message. ip is the connecting client's
+// address, helo the name it introduced itself with and mailFrom the
+// envelope sender.
+func (v *Verifier) Verify(ctx context.Context, ip net.IP, helo, mailFrom string, raw []byte) *Results {
+	results := &Results{hostname: v.Hostname}
+
+	results.SPFDomain = domainOf(mailFrom)
+	if results.SPFDomain == "" {
+		// Null reverse-path (bounces), so check the HELO identity instead
+		results.SPFDomain = strings.ToLower(helo)
+		mailFrom = "postmaster@" + results.SPFDomain
+	}
+	results.SPF = v.checkSPF(ctx, ip, results.SPFDomain, mailFrom, helo)
+
+	header, body := splitMessage(raw)
+
+	results.DKIM = v.checkDKIM(ctx, header, body)
+
+	results.FromDomain = fromDomain(header)
+	results.DMARC, results.DMARCPolicy = v.checkDMARC(ctx, results)
+
+	return results
+}
+
+// Verdict condenses the results into pass, fail or none for display
+func (r *Results) Verdict() Result {
+	switch r.DMARC {
+	case Pass, Fail:
+		return r.DMARC
+	}
+
+	if r.SPF == Fail {
+		return Fail
+	}
+
+	// No DMARC policy published, but an aligned pass is still worth showing
+	if r.FromDomain != "" && ((r.SPF == Pass && aligned(r.SPFDomain, r.FromDomain, false)) || r.dkimAligned(false)) {
+		return Pass
+	}
+
+	return None
+}
+
+// Header renders the results in the style of an Authentication-Results
+// header field (RFC 8601)
+func (r *Results) Header() string {
+	parts := []string{r.hostname}
+
+	parts = append(parts, fmt.Sprintf("spf=%s smtp.mailfrom=%s", r.SPF, r.SPFDomain))
+
+	if len(r.DKIM) == 0 {
+		parts = append(parts, "dkim=none")
+	}
+	for _, d := range r.DKIM {
+		part := fmt.Sprintf("dkim=%s", d.Result)
+		if d.Reason != "" {
+			part += fmt.Sprintf(" (%s)", d.Reason)
+		}
+		part += fmt.Sprintf(" header.d=%s header.s=%s", d.Domain, d.Selector)
+		parts = append(parts, part)
+	}
+
+	dmarc := fmt.Sprintf("dmarc=%s", r.DMARC)
+	if r.DMARCPolicy != "" {
+		dmarc += fmt.Sprintf(" (p=%s)", r.DMARCPolicy)
+	}
+	dmarc += fmt.Sprintf(" header.from=%s", r.FromDomain)
+	parts = append(parts, dmarc)
+
+	return strings.Join(parts, ";\r\n\t")
+}
+
+func (r *Results) dkimAligned(strict bool) bool {
+	for _, d := range r.DKIM {
+		if d.Result == Pass && aligned(d.Domain, r.FromDomain, strict) {
+			return true
+		}
+	}
+	return false
+}
+
+// Badge returns a short Slack mrkdwn blurb describing a verdict
+func Badge(verdict string) string {
+	switch Result(verdict) {
+	case Pass:
+		return ":white_check_mark: sender verified"
+	case Fail:
+		return ":warning: *sender failed verification, this message may be spoofed*"
+	default:
+		return ":grey_question: sender could not be verified"
+	}
+}
+
+func domainOf(address string) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[i+1:], "<> "))
+}
+
+// Distinguishes "this record doesn't exist" from transient DNS failures
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Headers returns a message's header fields in the order they appear, with
+// folded lines joined back together
+func Headers(raw []byte) []HeaderField {
+	fields, _ := splitMessage(raw)
+
+	headers := make([]HeaderField, len(fields))
+	for i, field := range fields {
+		headers[i] = HeaderField{
+			Name:  field.name,
+			Value: strings.TrimSpace(strings.ReplaceAll(headerValue(field), "\r\n", "")),
+		}
+	}
+	return headers
+}
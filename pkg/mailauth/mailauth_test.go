@@ -0,0 +1,436 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Answers lookups from fixed records. Names that aren't there don't exist,
+// and names in fail time out.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail map[string]bool
+
+	lookups int
+}
+
+func (r *fakeResolver) err(name string) error {
+	if r.fail[name] {
+		return &net.DNSError{Err: "timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, r.err(host)
+	}
+
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, r.err(name)
+	}
+
+	var mxs []*net.MX
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, nil
+}
+
+func TestSPF(t *testing.T) {
+	// include:0.chain -> include:1.chain -> ... each costing a lookup
+	chain := map[string][]string{}
+	for i := 0; i < 12; i++ {
+		chain[fmt.Sprintf("%d.chain.test", i)] = []string{fmt.Sprintf("v=spf1 include:%d.chain.test -all", i+1)}
+	}
+	chain["12.chain.test"] = []string{"v=spf1 +all"}
+
+	tests := []struct {
+		name   string
+		record []string
+		ip     string
+		want   Result
+	}{
+		{"ip4 match", []string{"v=spf1 ip4:192.0.2.0/24 -all"}, "192.0.2.10", Pass},
+		{"ip4 miss fails", []string{"v=spf1 ip4:192.0.2.0/24 -all"}, "198.51.100.1", Fail},
+		{"softfail", []string{"v=spf1 ip4:192.0.2.1 ~all"}, "198.51.100.1", SoftFail},
+		{"neutral qualifier", []string{"v=spf1 ?ip4:198.51.100.1 -all"}, "198.51.100.1", Neutral},
+		{"no match is neutral", []string{"v=spf1 ip4:192.0.2.1"}, "198.51.100.1", Neutral},
+		{"ip6", []string{"v=spf1 ip6:2001:db8::/32 -all"}, "2001:db8::1", Pass},
+		{"a", []string{"v=spf1 a -all"}, "203.0.113.5", Pass},
+		{"a with cidr", []string{"v=spf1 a:host.example.test/24 -all"}, "203.0.113.99", Pass},
+		{"mx", []string{"v=spf1 mx -all"}, "203.0.113.25", Pass},
+		{"include pass", []string{"v=spf1 include:other.test -all"}, "198.51.100.7", Pass},
+		{"include miss falls through", []string{"v=spf1 include:other.test -all"}, "192.0.2.200", Fail},
+		{"include without record", []string{"v=spf1 include:missing.test -all"}, "192.0.2.1", PermError},
+		{"redirect", []string{"v=spf1 redirect=other.test"}, "198.51.100.7", Pass},
+		{"exists with macro", []string{"v=spf1 exists:%{ir}.allow.test -all"}, "192.0.2.77", Pass},
+		{"ptr never matches", []string{"v=spf1 ptr -all"}, "192.0.2.1", Fail},
+		{"no record", nil, "192.0.2.1", None},
+		{"two records", []string{"v=spf1 -all", "v=spf1 +all"}, "192.0.2.1", PermError},
+		{"unknown mechanism", []string{"v=spf1 bogus -all"}, "192.0.2.1", PermError},
+		{"too many lookups", []string{"v=spf1 include:0.chain.test -all"}, "192.0.2.1", PermError},
+		{"temporary failure", []string{"v=spf1 include:flaky.test -all"}, "192.0.2.1", TempError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &fakeResolver{
+				txt: map[string][]string{
+					"other.test": {"v=spf1 ip4:198.51.100.0/24 -all"},
+				},
+				ip: map[string][]string{
+					"example.test":          {"203.0.113.5"},
+					"host.example.test":     {"203.0.113.1"},
+					"mx.example.test":       {"203.0.113.25"},
+					"77.2.0.192.allow.test": {"127.0.0.2"},
+				},
+				mx:   map[string][]string{"example.test": {"mx.example.test"}},
+				fail: map[string]bool{"flaky.test": true},
+			}
+			for name, txts := range chain {
+				r.txt[name] = txts
+			}
+			if test.record != nil {
+				r.txt["example.test"] = test.record
+			}
+
+			v := &Verifier{Resolver: r}
+			got := v.checkSPF(context.Background(), net.ParseIP(test.ip), "example.test", "bounce@example.test", "mail.example.test")
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// The lookup limit counts every mechanism that needs DNS, not just includes
+func TestSPFLookupLimit(t *testing.T) {
+	terms := []string{"v=spf1"}
+	for i := 0; i < 11; i++ {
+		terms = append(terms, fmt.Sprintf("a:host%d.test", i))
+	}
+	terms = append(terms, "+all")
+
+	r := &fakeResolver{txt: map[string][]string{"example.test": {strings.Join(terms, " ")}}}
+	v := &Verifier{Resolver: r}
+
+	if got := v.checkSPF(context.Background(), net.ParseIP("192.0.2.1"), "example.test", "a@example.test", ""); got != PermError {
+		t.Errorf("got %s, want %s", got, PermError)
+	}
+	if r.lookups > maxSPFLookups+1 {
+		t.Errorf("made %d lookups, should stop after %d", r.lookups, maxSPFLookups+1)
+	}
+}
+
+// Examples from RFC 6376 section 3.4.6
+func TestCanonicalization(t *testing.T) {
+	header := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+
+	fields, _ := splitMessage([]byte(header + "\r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("got %d header fields, want 2", len(fields))
+	}
+
+	tests := []struct {
+		canon      string
+		wantHeader string
+		wantBody   string
+	}{
+		{"relaxed", "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+		{"simple", header, " C \r\nD \t E\r\n"},
+	}
+
+	for _, test := range tests {
+		got := canonicalizeHeader(fields[0].raw, test.canon) + canonicalizeHeader(fields[1].raw, test.canon)
+		if got != test.wantHeader {
+			t.Errorf("%s header: got %q, want %q", test.canon, got, test.wantHeader)
+		}
+		if got := string(canonicalizeBody(body, test.canon)); got != test.wantBody {
+			t.Errorf("%s body: got %q, want %q", test.canon, got, test.wantBody)
+		}
+	}
+
+	if got := string(canonicalizeBody(nil, "simple")); got != "\r\n" {
+		t.Errorf("empty simple body: got %q", got)
+	}
+	if got := string(canonicalizeBody(nil, "relaxed")); got != "" {
+		t.Errorf("empty relaxed body: got %q", got)
+	}
+}
+
+var testKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// Signs a message with testKey, signing the From and Subject headers
+func sign(t *testing.T, message, canon, extraTags string) string {
+	t.Helper()
+
+	return signWith(t, message, canon, extraTags, "ed25519", func(digest []byte) []byte {
+		return ed25519.Sign(testKey, digest)
+	})
+}
+
+// Signs with a key of keyType, using signer on the SHA-256 header hash
+func signWith(t *testing.T, message, canon, extraTags, keyType string, signer func(digest []byte) []byte) string {
+	t.Helper()
+
+	split := strings.SplitN(canon, "/", 2)
+	fields, body := splitMessage([]byte(message))
+
+	bodyHash := sha256.Sum256(canonicalizeBody(body, split[1]))
+	value := fmt.Sprintf(" v=1; a=%s-sha256; c=%s; d=example.test; s=sel; h=from:subject;%s bh=%s; b=", keyType, canon, extraTags, base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	for _, name := range []string{"From", "Subject"} {
+		for _, f := range fields {
+			if f.name == name {
+				h.Write([]byte(canonicalizeHeader(f.raw, split[0])))
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader("DKIM-Signature:"+value+"\r\n", split[0]), "\r\n")))
+
+	sig := signer(h.Sum(nil))
+	return "DKIM-Signature:" + value + base64.StdEncoding.EncodeToString(sig) + "\r\n" + message
+}
+
+func TestDKIM(t *testing.T) {
+	message := "From: Someone <someone@example.test>\r\nSubject: Hello  there\r\n\r\nHi!\r\n"
+
+	tests := []struct {
+		name   string
+		signed func() string
+		want   Result
+	}{
+		{"relaxed", func() string {
+			return sign(t, message, "relaxed/relaxed", "")
+		}, Pass},
+		{"simple", func() string {
+			return sign(t, message, "simple/simple", "")
+		}, Pass},
+		{"relaxed tolerates whitespace changes", func() string {
+			signed := sign(t, message, "relaxed/relaxed", "")
+			signed = strings.Replace(signed, "Subject: Hello  there", "Subject:   Hello there", 1)
+			return strings.Replace(signed, "Hi!\r\n", "Hi!   \r\n\r\n", 1)
+		}, Pass},
+		{"simple catches header whitespace changes", func() string {
+			signed := sign(t, message, "simple/simple", "")
+			return strings.Replace(signed, "Subject: Hello  there", "Subject: Hello there", 1)
+		}, Fail},
+		{"simple catches body whitespace changes", func() string {
+			signed := sign(t, message, "simple/simple", "")
+			return strings.Replace(signed, "Hi!\r\n", "Hi! \r\n", 1)
+		}, Fail},
+		{"changed body", func() string {
+			return sign(t, message, "relaxed/relaxed", "") + "Also, send money.\r\n"
+		}, Fail},
+		{"changed subject", func() string {
+			signed := sign(t, message, "relaxed/relaxed", "")
+			return strings.Replace(signed, "Hello", "Goodbye", 1)
+		}, Fail},
+		{"body length limit", func() string {
+			return sign(t, message, "relaxed/relaxed", " l=5;")
+		}, PermError},
+	}
+
+	r := &fakeResolver{txt: map[string][]string{
+		"sel._domainkey.example.test": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(testKey.Public().(ed25519.PublicKey))},
+	}}
+	v := &Verifier{Resolver: r}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, body := splitMessage([]byte(test.signed()))
+
+			results := v.checkDKIM(context.Background(), header, body)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			if results[0].Result != test.want {
+				t.Errorf("got %s (%s), want %s", results[0].Result, results[0].Reason, test.want)
+			}
+		})
+	}
+}
+
+func TestDKIMKeys(t *testing.T) {
+	message := "From: Someone <someone@example.test>\r\nSubject: Hello\r\n\r\nHi!\r\n"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedRSA := signWith(t, message, "relaxed/relaxed", "", "rsa", func(digest []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	})
+
+	// Too short to generate or sign with anymore, but it only needs to be
+	// published for the check to turn it away
+	weak := &rsa.PublicKey{N: new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 511), big.NewInt(1)), E: 65537}
+	weakPKIX, err := x509.MarshalPKIXPublicKey(weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed25519Record := "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(testKey.Public().(ed25519.PublicKey))
+	tests := []struct {
+		name    string
+		signed  string
+		records []string
+		want    Result
+	}{
+		{"rsa", signedRSA, []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pkix)}, Pass},
+		{"bare PKCS#1 rsa", signedRSA, []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))}, Pass},
+		{"512-bit rsa", signedRSA, []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(weakPKIX)}, PermError},
+		{"one record", sign(t, message, "relaxed/relaxed", ""), []string{ed25519Record}, Pass},
+		{"duplicate records", sign(t, message, "relaxed/relaxed", ""), []string{ed25519Record, ed25519Record}, PermError},
+		// Gluing these back together would make a valid key
+		{"key split across records", sign(t, message, "relaxed/relaxed", ""), []string{ed25519Record[:30], ed25519Record[30:]}, PermError},
+		{"no records", sign(t, message, "relaxed/relaxed", ""), []string{}, PermError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &Verifier{Resolver: &fakeResolver{txt: map[string][]string{
+				"sel._domainkey.example.test": test.records,
+			}}}
+			header, body := splitMessage([]byte(test.signed))
+
+			results := v.checkDKIM(context.Background(), header, body)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			if results[0].Result != test.want {
+				t.Errorf("got %s (%s), want %s", results[0].Result, results[0].Reason, test.want)
+			}
+		})
+	}
+}
+
+func TestAligned(t *testing.T) {
+	tests := []struct {
+		domain, from string
+		strict       bool
+		want         bool
+	}{
+		{"example.com", "example.com", true, true},
+		{"mail.example.com", "example.com", true, false},
+		{"mail.example.com", "example.com", false, true},
+		{"other.com", "example.com", false, false},
+		{"mail.bank.co.uk", "bank.co.uk", false, true},
+		{"attacker.co.uk", "bank.co.uk", false, false},
+		{"co.uk", "bank.co.uk", false, false},
+		{"Example.COM", "example.com.", false, true},
+	}
+
+	for _, test := range tests {
+		if got := aligned(test.domain, test.from, test.strict); got != test.want {
+			t.Errorf("aligned(%q, %q, %v) = %v, want %v", test.domain, test.from, test.strict, got, test.want)
+		}
+	}
+}
+
+func TestDMARC(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  string
+		from    string
+		dkim    string
+		spf     string
+		want    Result
+		wantPol string
+	}{
+		{"relaxed dkim", "v=DMARC1; p=reject", "bank.co.uk", "mail.bank.co.uk", "", Pass, "reject"},
+		{"relaxed spf", "v=DMARC1; p=reject", "bank.co.uk", "", "bounces.bank.co.uk", Pass, "reject"},
+		{"strict dkim", "v=DMARC1; p=reject; adkim=s", "bank.co.uk", "mail.bank.co.uk", "", Fail, "reject"},
+		{"strict spf", "v=DMARC1; p=reject; aspf=s", "bank.co.uk", "", "bounces.bank.co.uk", Fail, "reject"},
+		{"same public suffix", "v=DMARC1; p=reject", "bank.co.uk", "attacker.co.uk", "attacker.co.uk", Fail, "reject"},
+		{"subdomain uses the organizational record", "v=DMARC1; p=quarantine; sp=reject", "alerts.bank.co.uk", "attacker.co.uk", "", Fail, "reject"},
+		{"bad policy", "v=DMARC1; p=whatever", "bank.co.uk", "mail.bank.co.uk", "", PermError, ""},
+		{"no record", "", "bank.co.uk", "mail.bank.co.uk", "", None, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &fakeResolver{txt: map[string][]string{
+				// Nothing at the public suffix should ever be looked at
+				"_dmarc.co.uk": {"v=DMARC1; p=none"},
+			}}
+			if test.record != "" {
+				r.txt["_dmarc.bank.co.uk"] = []string{test.record}
+			}
+			v := &Verifier{Resolver: r}
+
+			results := &Results{FromDomain: test.from, SPF: None}
+			if test.dkim != "" {
+				results.DKIM = []DKIMResult{{Result: Pass, Domain: test.dkim}}
+			}
+			if test.spf != "" {
+				results.SPF, results.SPFDomain = Pass, test.spf
+			}
+
+			got, policy := v.checkDMARC(context.Background(), results)
+			if got != test.want || policy != test.wantPol {
+				t.Errorf("got %s (p=%s), want %s (p=%s)", got, policy, test.want, test.wantPol)
+			}
+		})
+	}
+}
+
+// A forged From on a domain sharing a public suffix mustn't come out as
+// verified, DMARC record or not
+func TestVerdictPublicSuffix(t *testing.T) {
+	results := &Results{
+		SPF:        Pass,
+		SPFDomain:  "attacker.co.uk",
+		DKIM:       []DKIMResult{{Result: Pass, Domain: "attacker.co.uk"}},
+		DMARC:      None,
+		FromDomain: "bank.co.uk",
+	}
+
+	if got := results.Verdict(); got == Pass {
+		t.Errorf("got %s, want anything but pass", got)
+	}
+}
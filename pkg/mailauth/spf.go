@@ -0,0 +1,396 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RFC 7208 section 4.6.4
+const maxSPFLookups = 10
+
+var (
+	errSPFPerm = errors.New("permanent SPF error")
+	errSPFTemp = errors.New("temporary SPF error")
+)
+
+type spfChecker struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+func (v *Verifier) checkSPF(ctx context.Context, ip net.IP, domain, sender, helo string) Result {
+	if ip == nil || domain == "" {
+		return None
+	}
+
+	c := &spfChecker{
+		resolver: v.Resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+
+	return c.check(ctx, domain)
+}
+
+func (c *spfChecker) check(ctx context.Context, domain string) Result {
+	record, err := c.record(ctx, domain)
+	if err == errSPFTemp {
+		return TempError
+	} else if err == errSPFPerm {
+		return PermError
+	} else if record == "" {
+		return None
+	}
+
+	var redirect string
+
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.ToLower(term[:i]) == "redirect" {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		result := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result = Fail
+			term = term[1:]
+		case '~':
+			result = SoftFail
+			term = term[1:]
+		case '?':
+			result = Neutral
+			term = term[1:]
+		}
+
+		matched, err := c.match(ctx, domain, term)
+		if err == errSPFTemp {
+			return TempError
+		} else if err != nil {
+			return PermError
+		}
+
+		if matched {
+			return result
+		}
+	}
+
+	if redirect != "" {
+		c.lookups++
+		if c.lookups > maxSPFLookups {
+			return PermError
+		}
+
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError
+		}
+
+		result := c.check(ctx, target)
+		if result == None {
+			return PermError
+		}
+		return result
+	}
+
+	return Neutral
+}
+
+// Fetches the domain's SPF record, returning "" if there isn't one
+func (c *spfChecker) record(ctx context.Context, domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", errSPFTemp
+	}
+
+	record := ""
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				// Multiple records are an error (RFC 7208 section 4.5)
+				return "", errSPFPerm
+			}
+			record = txt
+		}
+	}
+
+	return record, nil
+}
+
+func (c *spfChecker) match(ctx context.Context, domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return c.matchIP(strings.TrimPrefix(arg, ":"))
+	}
+
+	// Everything past this point costs a DNS lookup
+	c.lookups++
+	if c.lookups > maxSPFLookups {
+		return false, errSPFPerm
+	}
+
+	target, cidr4, cidr6, err := c.parseDomainSpec(arg, domain)
+	if err != nil {
+		return false, err
+	}
+
+	switch name {
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+
+		switch c.check(ctx, target) {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, errSPFTemp
+		default:
+			return false, errSPFPerm
+		}
+	case "a":
+		return c.matchHost(ctx, target, cidr4, cidr6)
+	case "mx":
+		mxs, err := c.resolver.LookupMX(ctx, target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, errSPFTemp
+		}
+		if len(mxs) > maxSPFLookups {
+			return false, errSPFPerm
+		}
+
+		for _, mx := range mxs {
+			matched, err := c.matchHost(ctx, mx.Host, cidr4, cidr6)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "exists":
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, errSPFTemp
+		}
+		return len(addrs) > 0, nil
+	case "ptr":
+		// Deprecated and expensive, so we never match it (RFC 7208 section 5.5)
+		return false, nil
+	}
+
+	return false, errSPFPerm
+}
+
+func (c *spfChecker) matchIP(arg string) (bool, error) {
+	if !strings.Contains(arg, "/") {
+		if strings.Contains(arg, ":") {
+			arg += "/128"
+		} else {
+			arg += "/32"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(arg)
+	if err != nil {
+		return false, errSPFPerm
+	}
+
+	return network.Contains(c.ip), nil
+}
+
+func (c *spfChecker) matchHost(ctx context.Context, host string, cidr4, cidr6 int) (bool, error) {
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, errSPFTemp
+	}
+
+	for _, addr := range addrs {
+		var network *net.IPNet
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			network = &net.IPNet{IP: ip4, Mask: net.CIDRMask(cidr4, 32)}
+		} else {
+			network = &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(cidr6, 128)}
+		}
+
+		if network.Contains(c.ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Parses [":" domain-spec] [ "/" ip4-cidr ] [ "//" ip6-cidr ]
+func (c *spfChecker) parseDomainSpec(arg, domain string) (target string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	target = domain
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		cidr6, err = strconv.Atoi(arg[i+2:])
+		if err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		cidr4, err = strconv.Atoi(arg[i+1:])
+		if err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:i]
+	}
+
+	if strings.HasPrefix(arg, ":") {
+		target, err = c.expand(arg[1:], domain)
+		if err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	return strings.TrimSuffix(target, "."), cidr4, cidr6, nil
+}
+
+// Expands macros in a domain-spec (RFC 7208 section 7)
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+		if i >= len(spec) {
+			return "", errSPFPerm
+		}
+
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, err := c.macroValue(macro[0], domain)
+		if err != nil {
+			return "", err
+		}
+		macro = macro[1:]
+
+		digits := 0
+		for len(macro) > 0 && macro[0] >= '0' && macro[0] <= '9' {
+			digits = digits*10 + int(macro[0]-'0')
+			macro = macro[1:]
+		}
+
+		reverse := false
+		if len(macro) > 0 && (macro[0] == 'r' || macro[0] == 'R') {
+			reverse = true
+			macro = macro[1:]
+		}
+
+		delimiters := macro
+		if delimiters == "" {
+			delimiters = "."
+		}
+
+		labels := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(labels)-1; l < r; l, r = l+1, r-1 {
+				labels[l], labels[r] = labels[r], labels[l]
+			}
+		}
+		if digits > 0 && digits < len(labels) {
+			labels = labels[len(labels)-digits:]
+		}
+
+		out.WriteString(strings.Join(labels, "."))
+	}
+
+	return out.String(), nil
+}
+
+func (c *spfChecker) macroValue(letter byte, domain string) (string, error) {
+	switch letter {
+	case 's', 'S':
+		return c.sender, nil
+	case 'l', 'L':
+		return strings.SplitN(c.sender, "@", 2)[0], nil
+	case 'o', 'O':
+		return domainOf(c.sender), nil
+	case 'd', 'D':
+		return domain, nil
+	case 'h', 'H':
+		return c.helo, nil
+	case 'v', 'V':
+		if c.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'i', 'I':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+
+		nibbles := make([]string, 0, 32)
+		for _, b := range c.ip.To16() {
+			nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+		}
+		return strings.Join(nibbles, "."), nil
+	}
+
+	return "", errSPFPerm
+}
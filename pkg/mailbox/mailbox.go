@@ -0,0 +1,81 @@
+// Package mailbox is what the IMAP and POP3 servers have in common: logging
+// in to an address with its app password and listing its emails.
+package mailbox
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticate logs in to an address. The username can be the full address
+// or just the part before the @.
+func Authenticate(username, password string) (db.Address, error) {
+	var address db.Address
+
+	split := strings.SplitN(strings.ToLower(strings.TrimSpace(username)), "@", 2)
+	query := db.DB.Where("id = ?", split[0])
+	if len(split) == 2 {
+		query = query.Where("domain = ?", split[1])
+	}
+
+	if tx := query.First(&address); tx.Error != nil {
+		return address, ErrInvalidCredentials
+	}
+
+	if address.AppPasswordHash == "" || subtle.ConstantTimeCompare([]byte(ids.Hash(password)), []byte(address.AppPasswordHash)) != 1 {
+		return address, ErrInvalidCredentials
+	}
+
+	return address, nil
+}
+
+// NewPassword issues a new app password for an address, replacing any
+// previous one
+func NewPassword(address *db.Address) (string, error) {
+	password := ids.Token()
+
+	address.AppPasswordHash = ids.Hash(password)
+	if tx := db.DB.Model(address).Update("app_password_hash", address.AppPasswordHash); tx.Error != nil {
+		return "", tx.Error
+	}
+
+	return password, nil
+}
+
+// Messages lists an address's emails in the order they arrived, leaving out
+// deleted ones
+func Messages(address db.Address) ([]db.Email, error) {
+	var emails []db.Email
+	tx := db.DB.Where("address_id = ? AND NOT deleted", address.ID).Order("uid").Find(&emails)
+	return emails, tx.Error
+}
+
+// Raw returns an email the way mail clients expect it, with CRLF line
+// endings throughout
+func Raw(email db.Email) []byte {
+	content := strings.ReplaceAll(email.Content, "\r\n", "\n")
+	return []byte(strings.ReplaceAll(content, "\n", "\r\n"))
+}
+
+// SetSeen marks emails as read or unread
+func SetSeen(emailIDs []string, seen bool) error {
+	if len(emailIDs) == 0 {
+		return nil
+	}
+	return db.DB.Model(&db.Email{}).Where("id IN ?", emailIDs).Update("seen", seen).Error
+}
+
+// Delete hides emails from mail clients. They're kept around for Slack and
+// the web viewer.
+func Delete(emailIDs []string) error {
+	if len(emailIDs) == 0 {
+		return nil
+	}
+	return db.DB.Model(&db.Email{}).Where("id IN ?", emailIDs).Update("deleted", true).Error
+}
@@ -0,0 +1,161 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+)
+
+func init() {
+	Register("discord", func(target string) Notifier { return Discord{WebhookURL: target} }, func(target string) error {
+		if !strings.HasPrefix(target, "https://discord.com/api/webhooks/") && !strings.HasPrefix(target, "https://discordapp.com/api/webhooks/") {
+			return errors.New("needs a Discord webhook URL")
+		}
+		return nil
+	})
+}
+
+// Discord's limits on messages and embeds. The embed total covers all of an
+// embed's text put together.
+const (
+	maxDiscordContent     = 2000
+	maxDiscordTitle       = 256
+	maxDiscordDescription = 4096
+	maxDiscordFields      = 25
+	maxDiscordFieldName   = 256
+	maxDiscordFieldValue  = 1024
+	maxDiscordEmbed       = 6000
+)
+
+// Discord posts to a channel through one of its incoming webhooks
+type Discord struct {
+	WebhookURL string
+}
+
+type discordMessage struct {
+	Content string         `json:"content,omitempty"`
+	Embeds  []discordEmbed `json:"embeds,omitempty"`
+
+	// Emails can mention @everyone, so don't let them
+	AllowedMentions struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title,omitempty"`
+	URL         string         `json:"url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Fields      []discordField `json:"fields,omitempty"`
+}
+
+type discordField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// How many characters of an embed count towards maxDiscordEmbed
+func (e discordEmbed) length() int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	return n
+}
+
+// Brings an embed within Discord's limits, which would otherwise reject the
+// whole message. The description gets whatever room the rest leaves.
+func (e *discordEmbed) fit() {
+	e.Title = truncate(e.Title, maxDiscordTitle)
+
+	if len(e.Fields) > maxDiscordFields {
+		e.Fields = e.Fields[:maxDiscordFields]
+	}
+	for i := range e.Fields {
+		// Empty names and values aren't allowed either
+		e.Fields[i].Name = truncate(placeholder(e.Fields[i].Name, "\u200b"), maxDiscordFieldName)
+		e.Fields[i].Value = truncate(placeholder(e.Fields[i].Value, "\u200b"), maxDiscordFieldValue)
+	}
+
+	description := e.Description
+	e.Description = ""
+	for len(e.Fields) > 0 && e.length() > maxDiscordEmbed {
+		e.Fields = e.Fields[:len(e.Fields)-1]
+	}
+
+	room := maxDiscordEmbed - e.length()
+	if room > maxDiscordDescription {
+		room = maxDiscordDescription
+	}
+	if room > 0 {
+		e.Description = truncate(description, room)
+	}
+}
+
+func (d Discord) send(msg discordMessage) error {
+	msg.AllowedMentions.Parse = []string{}
+	return postJSON(http.MethodPost, d.WebhookURL, nil, msg)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// Stands in for blank values, which chat services tend to reject
+func placeholder(s, fallback string) string {
+	if strings.TrimSpace(s) == "" {
+		return fallback
+	}
+	return s
+}
+
+func (d Discord) NewMail(mail Mail) error {
+	text := mail.Parsed.TextBody
+	if strings.TrimSpace(text) == "" {
+		text = "_this email only has an HTML version, open it to read it_"
+	}
+
+	embed := discordEmbed{
+		Title:       placeholder(mail.Email.Subject, "(no subject)"),
+		URL:         viewURL(mail.Email.ID),
+		Description: text,
+		Fields: []discordField{
+			{Name: "From", Value: placeholder(mail.Email.From, "(unknown sender)")},
+			{Name: "To", Value: fullAddress(mail.Address)},
+		},
+	}
+	if strings.TrimSpace(mail.Email.Tag) != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Tag", Value: mail.Email.Tag})
+	}
+
+	if len(mail.Attachments) > 0 {
+		var lines []string
+		for _, a := range mail.Attachments {
+			lines = append(lines, fmt.Sprintf("[%s](%s/attachments/%s)", placeholder(a.Filename, "attachment"), viewURL(mail.Email.ID), a.ID))
+		}
+		embed.Fields = append(embed.Fields, discordField{Name: "Attachments", Value: strings.Join(lines, "\n")})
+	}
+
+	embed.fit()
+
+	return d.send(discordMessage{
+		Content: truncate(fmt.Sprintf("New email for %s", fullAddress(mail.Address)), maxDiscordContent),
+		Embeds:  []discordEmbed{embed},
+	})
+}
+
+func (d Discord) Expired(address db.Address) error {
+	return d.send(discordMessage{Content: fmt.Sprintf("⏰ %s has expired, so it will no longer receive mail.", fullAddress(address))})
+}
+
+func (d Discord) Deactivated(address db.Address, reason string) error {
+	return d.send(discordMessage{Content: fmt.Sprintf("❌ %s, %s has been deactivated.", reason, fullAddress(address))})
+}
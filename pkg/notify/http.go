@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+)
+
+// Shares the guard against private addresses with webhooks
+var client = safehttp.Client
+
+func init() {
+	Register("http", func(target string) Notifier { return HTTP{URL: target} }, validateURL)
+}
+
+func validateURL(target string) error {
+	_, err := safehttp.CheckURL(target)
+	if err == safehttp.ErrBlockedHost {
+		return errors.New("can't point at a private address")
+	}
+	return err
+}
+
+// Sends body as JSON, treating anything but a 2xx response as an error
+func postJSON(method, target string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// HTTP posts a small JSON event to any URL. For the full email, use a
+// webhook instead.
+type HTTP struct {
+	URL string
+}
+
+type httpEvent struct {
+	Event   string    `json:"event"`
+	Address string    `json:"address"`
+	Time    time.Time `json:"time"`
+
+	Email *httpEmail `json:"email,omitempty"`
+
+	// Why an address was deactivated
+	Reason string `json:"reason,omitempty"`
+}
+
+type httpEmail struct {
+	ID      string `json:"id"`
+	Tag     string `json:"tag,omitempty"`
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	URL     string `json:"url"`
+}
+
+func (h HTTP) NewMail(mail Mail) error {
+	return postJSON(http.MethodPost, h.URL, nil, httpEvent{
+		Event:   "email.received",
+		Address: fullAddress(mail.Address),
+		Time:    mail.Email.CreatedAt,
+		Email: &httpEmail{
+			ID:      mail.Email.ID,
+			Tag:     mail.Email.Tag,
+			From:    mail.Email.From,
+			Subject: mail.Email.Subject,
+			URL:     viewURL(mail.Email.ID),
+		},
+	})
+}
+
+func (h HTTP) Expired(address db.Address) error {
+	return postJSON(http.MethodPost, h.URL, nil, httpEvent{
+		Event:   "address.expired",
+		Address: fullAddress(address),
+		Time:    address.ExpiresAt,
+	})
+}
+
+func (h HTTP) Deactivated(address db.Address, reason string) error {
+	return postJSON(http.MethodPost, h.URL, nil, httpEvent{
+		Event:   "address.deactivated",
+		Address: fullAddress(address),
+		Time:    time.Now(),
+		Reason:  reason,
+	})
+}
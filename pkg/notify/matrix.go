@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+)
+
+func init() {
+	Register("matrix", func(target string) Notifier { return Matrix{RoomID: target} }, func(target string) error {
+		if os.Getenv("MATRIX_HOMESERVER") == "" || os.Getenv("MATRIX_TOKEN") == "" {
+			return errors.New("isn't set up on this server")
+		}
+		if !strings.HasPrefix(target, "!") || !strings.Contains(target, ":") {
+			return errors.New("needs a room ID like !abc123:example.com")
+		}
+		return nil
+	})
+}
+
+// Matrix posts to a room as the bot user whose access token is in
+// MATRIX_TOKEN, on MATRIX_HOMESERVER
+type Matrix struct {
+	RoomID string
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+func (m Matrix) send(text, formatted string) error {
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(os.Getenv("MATRIX_HOMESERVER"), "/"),
+		url.PathEscape(m.RoomID),
+		ids.Token(),
+	)
+
+	msg := matrixMessage{MsgType: "m.text", Body: text}
+	if formatted != "" {
+		msg.Format = "org.matrix.custom.html"
+		msg.FormattedBody = formatted
+	}
+
+	return postJSON(http.MethodPut, endpoint, map[string]string{
+		"Authorization": "Bearer " + os.Getenv("MATRIX_TOKEN"),
+	}, msg)
+}
+
+func (m Matrix) NewMail(mail Mail) error {
+	subject := placeholder(mail.Email.Subject, "(no subject)")
+	from := placeholder(mail.Email.From, "(unknown sender)")
+	link := viewURL(mail.Email.ID)
+
+	text := fmt.Sprintf("New email for %s from %s\n%s\n\n%s\n\n%s", fullAddress(mail.Address), from, subject, truncate(mail.Parsed.TextBody, 4000), link)
+	formatted := fmt.Sprintf("New email for <code>%s</code> from %s<br><strong>%s</strong><br><a href=\"%s\">view email</a>",
+		html.EscapeString(fullAddress(mail.Address)),
+		html.EscapeString(from),
+		html.EscapeString(subject),
+		html.EscapeString(link),
+	)
+
+	return m.send(text, formatted)
+}
+
+func (m Matrix) Expired(address db.Address) error {
+	return m.send(fmt.Sprintf("⏰ %s has expired, so it will no longer receive mail.", fullAddress(address)), "")
+}
+
+func (m Matrix) Deactivated(address db.Address, reason string) error {
+	return m.send(fmt.Sprintf("❌ %s, %s has been deactivated.", reason, fullAddress(address)), "")
+}
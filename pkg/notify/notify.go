@@ -0,0 +1,100 @@
+// Package notify tells people about things happening to their addresses:
+// new mail arriving, and addresses expiring or being deactivated. Each
+// address picks where its notifications go.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+)
+
+// The notifier addresses use unless they pick another one
+const Slack = "slack"
+
+var ErrUnknownKind = errors.New("unknown notifier")
+
+// A newly received email
+type Mail struct {
+	Address db.Address
+	Email   db.Email
+	Parsed  parsemail.Email
+
+	Attachments []Attachment
+}
+
+type Attachment struct {
+	db.Attachment
+	Data []byte
+}
+
+type Notifier interface {
+	NewMail(mail Mail) error
+	Expired(address db.Address) error
+	Deactivated(address db.Address, reason string) error
+}
+
+type kind struct {
+	// Creates a notifier sending to target, e.g. a webhook URL
+	New func(target string) Notifier
+
+	// Checks a target before it's saved on an address
+	Validate func(target string) error
+}
+
+var kinds = map[string]kind{}
+
+// Register makes a kind of notifier available to addresses
+func Register(name string, new func(target string) Notifier, validate func(target string) error) {
+	kinds[name] = kind{New: new, Validate: validate}
+}
+
+// Kinds lists the registered kinds of notifiers
+func Kinds() []string {
+	var names []string
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that a kind exists and target makes sense for it
+func Validate(name, target string) error {
+	k, ok := kinds[name]
+	if !ok {
+		return ErrUnknownKind
+	}
+	if k.Validate == nil {
+		return nil
+	}
+	return k.Validate(target)
+}
+
+// For returns the notifier an address picked, falling back to Slack
+func For(address db.Address) Notifier {
+	name := address.Notifier
+	if name == "" {
+		name = Slack
+	}
+
+	k, ok := kinds[name]
+	if !ok {
+		log.Printf("address %s uses unknown notifier %q, falling back to slack", address.ID, name)
+		k = kinds[Slack]
+	}
+	return k.New(address.NotifierTarget)
+}
+
+func fullAddress(address db.Address) string {
+	return fmt.Sprintf("%s@%s", address.ID, address.Domain)
+}
+
+func viewURL(emailID string) string {
+	return fmt.Sprintf("%s/%s", os.Getenv("APP_DOMAIN"), emailID)
+}
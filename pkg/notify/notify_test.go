@@ -0,0 +1,473 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+)
+
+type request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// An endpoint that keeps every request it gets, and answers with status
+type endpoint struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []request
+}
+
+func newEndpoint(t *testing.T) *endpoint {
+	e := &endpoint{status: http.StatusNoContent}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		e.mu.Lock()
+		e.requests = append(e.requests, request{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: body})
+		e.mu.Unlock()
+
+		w.WriteHeader(e.status)
+	}))
+	t.Cleanup(e.Close)
+
+	// The endpoint is on loopback, which the real client won't talk to
+	old := client
+	client = safehttp.NewClient(true)
+	t.Cleanup(func() { client = old })
+
+	t.Setenv("APP_DOMAIN", "https://mail.test")
+	return e
+}
+
+// Decodes the only request the endpoint got
+func (e *endpoint) only(t *testing.T, v interface{}) request {
+	t.Helper()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.requests) != 1 {
+		t.Fatalf("endpoint got %d requests, want 1", len(e.requests))
+	}
+	r := e.requests[0]
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("%v: %s", err, r.Body)
+	}
+	return r
+}
+
+var address = db.Address{ID: "abc", Domain: "temp.test"}
+
+func testMail() Mail {
+	return Mail{
+		Address: address,
+		Email: db.Email{
+			ID:        "email1",
+			From:      "alice@example.com",
+			Subject:   "Confirm your account",
+			Tag:       "shopping",
+			CreatedAt: time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+		},
+		Parsed: parsemail.Email{TextBody: "Your code is 1234"},
+	}
+}
+
+func TestDiscordNewMail(t *testing.T) {
+	e := newEndpoint(t)
+
+	mail := testMail()
+	mail.Attachments = []Attachment{{Attachment: db.Attachment{ID: "att1", Filename: "receipt.pdf"}}}
+	if err := (Discord{WebhookURL: e.URL}).NewMail(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg discordMessage
+	r := e.only(t, &msg)
+	if r.Method != http.MethodPost {
+		t.Errorf("method %s", r.Method)
+	}
+
+	// Mentions have to be explicitly turned off, not just left out
+	if !strings.Contains(string(r.Body), `"allowed_mentions":{"parse":[]}`) {
+		t.Errorf("mentions not disabled: %s", r.Body)
+	}
+	if msg.Content != "New email for abc@temp.test" {
+		t.Errorf("content %q", msg.Content)
+	}
+	if len(msg.Embeds) != 1 {
+		t.Fatalf("got %d embeds", len(msg.Embeds))
+	}
+
+	embed := msg.Embeds[0]
+	if embed.Title != "Confirm your account" || embed.URL != "https://mail.test/email1" || embed.Description != "Your code is 1234" {
+		t.Errorf("unexpected embed %+v", embed)
+	}
+	want := []discordField{
+		{Name: "From", Value: "alice@example.com"},
+		{Name: "To", Value: "abc@temp.test"},
+		{Name: "Tag", Value: "shopping"},
+		{Name: "Attachments", Value: "[receipt.pdf](https://mail.test/email1/attachments/att1)"},
+	}
+	if len(embed.Fields) != len(want) {
+		t.Fatalf("fields %+v, want %+v", embed.Fields, want)
+	}
+	for i := range want {
+		if embed.Fields[i] != want[i] {
+			t.Errorf("field %d is %+v, want %+v", i, embed.Fields[i], want[i])
+		}
+	}
+}
+
+func TestDiscordEmptyValues(t *testing.T) {
+	e := newEndpoint(t)
+
+	// Spam often has no From header, subject or text at all
+	mail := testMail()
+	mail.Email.From = ""
+	mail.Email.Subject = " "
+	mail.Email.Tag = ""
+	mail.Parsed.TextBody = ""
+	mail.Attachments = []Attachment{{Attachment: db.Attachment{ID: "att1"}}}
+	if err := (Discord{WebhookURL: e.URL}).NewMail(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg discordMessage
+	e.only(t, &msg)
+	embed := msg.Embeds[0]
+
+	if embed.Title != "(no subject)" {
+		t.Errorf("title %q", embed.Title)
+	}
+	if strings.TrimSpace(embed.Description) == "" {
+		t.Error("empty description")
+	}
+	for _, f := range embed.Fields {
+		if strings.TrimSpace(f.Name) == "" || strings.TrimSpace(f.Value) == "" {
+			t.Errorf("empty field %+v", f)
+		}
+		if f.Name == "From" && f.Value != "(unknown sender)" {
+			t.Errorf("From is %q", f.Value)
+		}
+		if f.Name == "Tag" {
+			t.Error("empty tag included")
+		}
+	}
+}
+
+func checkEmbedLimits(t *testing.T, embed discordEmbed) {
+	t.Helper()
+
+	if n := embed.length(); n > maxDiscordEmbed {
+		t.Errorf("embed is %d characters, over %d", n, maxDiscordEmbed)
+	}
+	if n := utf8.RuneCountInString(embed.Title); n > maxDiscordTitle {
+		t.Errorf("title is %d characters", n)
+	}
+	if n := utf8.RuneCountInString(embed.Description); n > maxDiscordDescription {
+		t.Errorf("description is %d characters", n)
+	}
+	if len(embed.Fields) > maxDiscordFields {
+		t.Errorf("%d fields", len(embed.Fields))
+	}
+	for _, f := range embed.Fields {
+		if n := utf8.RuneCountInString(f.Name); n > maxDiscordFieldName || n == 0 {
+			t.Errorf("field name is %d characters", n)
+		}
+		if n := utf8.RuneCountInString(f.Value); n > maxDiscordFieldValue || n == 0 {
+			t.Errorf("field %s is %d characters", f.Name, n)
+		}
+	}
+}
+
+func TestDiscordLimits(t *testing.T) {
+	e := newEndpoint(t)
+
+	// Everything at once is still too much for one embed, so the description
+	// gets squeezed
+	mail := testMail()
+	mail.Email.Subject = strings.Repeat("s", 1000)
+	mail.Email.From = strings.Repeat("f", 2000) + "@example.com"
+	mail.Email.Tag = strings.Repeat("t", 2000)
+	mail.Parsed.TextBody = strings.Repeat("é", 10000)
+	for i := 0; i < 100; i++ {
+		mail.Attachments = append(mail.Attachments, Attachment{Attachment: db.Attachment{ID: "att", Filename: strings.Repeat("a", 100)}})
+	}
+	if err := (Discord{WebhookURL: e.URL}).NewMail(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg discordMessage
+	e.only(t, &msg)
+	embed := msg.Embeds[0]
+
+	checkEmbedLimits(t, embed)
+	if embed.length() != maxDiscordEmbed {
+		t.Errorf("embed is %d characters, the description should fill it to %d", embed.length(), maxDiscordEmbed)
+	}
+	if !strings.HasSuffix(embed.Description, "…") {
+		t.Error("truncated description doesn't end with an ellipsis")
+	}
+}
+
+func TestDiscordFit(t *testing.T) {
+	tests := map[string]discordEmbed{
+		"short": {Title: "hi", Description: "hello", Fields: []discordField{{Name: "a", Value: "b"}}},
+		"long description": {
+			Title:       "hi",
+			Description: strings.Repeat("d", 5000),
+		},
+		"too many fields": {
+			Description: strings.Repeat("d", 5000),
+			Fields:      make([]discordField, 30),
+		},
+		"fields fill the embed": {
+			Title:       strings.Repeat("t", 300),
+			Description: "squeezed out",
+			Fields: func() []discordField {
+				var fields []discordField
+				for i := 0; i < 25; i++ {
+					fields = append(fields, discordField{Name: strings.Repeat("n", 300), Value: strings.Repeat("v", 2000)})
+				}
+				return fields
+			}(),
+		},
+	}
+
+	for name, embed := range tests {
+		t.Run(name, func(t *testing.T) {
+			embed.fit()
+			checkEmbedLimits(t, embed)
+		})
+	}
+
+	short := tests["short"]
+	short.fit()
+	if short.Description != "hello" || short.Fields[0].Value != "b" {
+		t.Errorf("embed within limits was changed: %+v", short)
+	}
+	many := tests["too many fields"]
+	many.fit()
+	if len(many.Fields) != maxDiscordFields {
+		t.Errorf("%d fields left, want %d", len(many.Fields), maxDiscordFields)
+	}
+}
+
+func TestDiscordStatusEvents(t *testing.T) {
+	e := newEndpoint(t)
+	d := Discord{WebhookURL: e.URL}
+
+	if err := d.Expired(address); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deactivated(address, "too much spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{"abc@temp.test has expired", "too much spam, abc@temp.test has been deactivated"} {
+		var msg discordMessage
+		json.Unmarshal(e.requests[i].Body, &msg)
+		if !strings.Contains(msg.Content, want) || len(msg.Embeds) != 0 {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	e := newEndpoint(t)
+	e.status = http.StatusBadRequest
+
+	if err := (Discord{WebhookURL: e.URL}).NewMail(testMail()); err == nil {
+		t.Error("a 400 response didn't count as an error")
+	}
+	if err := (HTTP{URL: e.URL}).Expired(address); err == nil {
+		t.Error("a 400 response didn't count as an error")
+	}
+}
+
+func TestPrivateAddressRefused(t *testing.T) {
+	e := newEndpoint(t)
+	client = safehttp.Client
+
+	if err := (HTTP{URL: e.URL}).Expired(address); err == nil {
+		t.Error("sent to a loopback address")
+	}
+	if len(e.requests) != 0 {
+		t.Error("endpoint was reached")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	e := newEndpoint(t)
+	h := HTTP{URL: e.URL + "/hook"}
+
+	if err := h.NewMail(testMail()); err != nil {
+		t.Fatal(err)
+	}
+	var event httpEvent
+	r := e.only(t, &event)
+
+	if r.Method != http.MethodPost || r.Path != "/hook" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected request %s %s %s", r.Method, r.Path, r.Header.Get("Content-Type"))
+	}
+	if event.Event != "email.received" || event.Address != "abc@temp.test" || event.Email == nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	want := httpEmail{ID: "email1", Tag: "shopping", From: "alice@example.com", Subject: "Confirm your account", URL: "https://mail.test/email1"}
+	if *event.Email != want {
+		t.Errorf("email %+v, want %+v", *event.Email, want)
+	}
+
+	// Status events don't have an email
+	if err := h.Deactivated(address, "too much spam"); err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(e.requests[1].Body, &raw)
+	if raw["event"] != "address.deactivated" || raw["reason"] != "too much spam" {
+		t.Errorf("unexpected event %v", raw)
+	}
+	if _, ok := raw["email"]; ok {
+		t.Errorf("status event has an email: %v", raw)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	e := newEndpoint(t)
+	t.Setenv("MATRIX_HOMESERVER", e.URL+"/")
+	t.Setenv("MATRIX_TOKEN", "secret-token")
+
+	mail := testMail()
+	mail.Email.From = `<script>@example.com`
+	if err := (Matrix{RoomID: "!room:example.com"}).NewMail(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg matrixMessage
+	r := e.only(t, &msg)
+
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.Path, "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/") {
+		t.Errorf("unexpected request %s %s", r.Method, r.Path)
+	}
+	if r.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("Authorization %q", r.Header.Get("Authorization"))
+	}
+	if msg.MsgType != "m.text" || msg.Format != "org.matrix.custom.html" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if !strings.Contains(msg.Body, "Your code is 1234") || !strings.Contains(msg.Body, "https://mail.test/email1") {
+		t.Errorf("body %q", msg.Body)
+	}
+	if strings.Contains(msg.FormattedBody, "<script>") || !strings.Contains(msg.FormattedBody, "&lt;script&gt;") {
+		t.Errorf("sender not escaped: %q", msg.FormattedBody)
+	}
+}
+
+func TestMatrixUnknownSender(t *testing.T) {
+	e := newEndpoint(t)
+	t.Setenv("MATRIX_HOMESERVER", e.URL)
+	t.Setenv("MATRIX_TOKEN", "secret-token")
+
+	mail := testMail()
+	mail.Email.From = ""
+	if err := (Matrix{RoomID: "!room:example.com"}).NewMail(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg matrixMessage
+	e.only(t, &msg)
+	if !strings.Contains(msg.Body, "from (unknown sender)") {
+		t.Errorf("body %q", msg.Body)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Setenv("MATRIX_HOMESERVER", "")
+
+	tests := []struct {
+		kind, target string
+		ok           bool
+	}{
+		{"http", "https://example.com/hook", true},
+		{"http", "ftp://example.com/hook", false},
+		{"http", "http://127.0.0.1:8080/hook", false},
+		{"http", "http://localhost/hook", false},
+		{"http", "http://[::1]/hook", false},
+		{"discord", "https://discord.com/api/webhooks/1/abc", true},
+		{"discord", "https://example.com/api/webhooks/1/abc", false},
+		{"matrix", "!room:example.com", false},
+		{"carrier-pigeon", "", false},
+	}
+
+	for _, tt := range tests {
+		if err := Validate(tt.kind, tt.target); (err == nil) != tt.ok {
+			t.Errorf("Validate(%q, %q) = %v", tt.kind, tt.target, err)
+		}
+	}
+
+	if err := Validate("carrier-pigeon", ""); err != ErrUnknownKind {
+		t.Errorf("unknown kind gave %v", err)
+	}
+
+	t.Setenv("MATRIX_HOMESERVER", "https://matrix.example.com")
+	t.Setenv("MATRIX_TOKEN", "secret-token")
+	if err := Validate("matrix", "!room:example.com"); err != nil {
+		t.Errorf("matrix: %v", err)
+	}
+	if err := Validate("matrix", "#room:example.com"); err == nil {
+		t.Error("matrix room alias accepted")
+	}
+}
+
+// Records what it was created with
+type fakeNotifier struct {
+	kind, target string
+}
+
+func (f fakeNotifier) NewMail(mail Mail) error                        { return nil }
+func (f fakeNotifier) Expired(address db.Address) error               { return nil }
+func (f fakeNotifier) Deactivated(address db.Address, r string) error { return nil }
+
+func TestFor(t *testing.T) {
+	// The real Slack notifier is registered by slackevents
+	Register(Slack, func(target string) Notifier { return fakeNotifier{kind: Slack, target: target} }, nil)
+	defer delete(kinds, Slack)
+
+	tests := []struct {
+		notifier, target string
+		want             Notifier
+	}{
+		{"", "", fakeNotifier{kind: Slack}},
+		{"discord", "https://discord.com/api/webhooks/1/abc", Discord{WebhookURL: "https://discord.com/api/webhooks/1/abc"}},
+		{"http", "https://example.com/hook", HTTP{URL: "https://example.com/hook"}},
+		{"matrix", "!room:example.com", Matrix{RoomID: "!room:example.com"}},
+		{"removed-kind", "whatever", fakeNotifier{kind: Slack, target: "whatever"}},
+	}
+
+	for _, tt := range tests {
+		a := address
+		a.Notifier, a.NotifierTarget = tt.notifier, tt.target
+		if got := For(a); got != tt.want {
+			t.Errorf("For(%q, %q) = %#v, want %#v", tt.notifier, tt.target, got, tt.want)
+		}
+	}
+
+	if got := Kinds(); strings.Join(got, ",") != "discord,http,matrix,slack" {
+		t.Errorf("Kinds() = %v", got)
+	}
+}
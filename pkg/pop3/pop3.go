@@ -0,0 +1,483 @@
+// Package pop3 is a small POP3 server for tools that can't speak IMAP. It
+// logs in with the same app passwords as IMAP, and deleting a message only
+// hides it from mail clients.
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/mailbox"
+)
+
+const (
+	// RFC 1939 asks for at least 10 minutes
+	idleTimeout = 10 * time.Minute
+
+	// Commands are short, so anything longer is someone up to no good
+	maxLineLength = 512
+)
+
+type Server struct {
+	Addr string
+
+	// Enables STLS, and is needed for ListenAndServeTLS
+	TLSConfig *tls.Config
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but with implicit TLS
+func (s *Server) ListenAndServeTLS() error {
+	l, err := tls.Listen("tcp", s.Addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(c)
+	}
+}
+
+// Only one session can have an address's maildrop open at a time, so two
+// clients can't delete messages out from under each other
+var locks = struct {
+	sync.Mutex
+	addresses map[string]bool
+}{addresses: map[string]bool{}}
+
+func lock(addressID string) bool {
+	locks.Lock()
+	defer locks.Unlock()
+
+	if locks.addresses[addressID] {
+		return false
+	}
+	locks.addresses[addressID] = true
+	return true
+}
+
+func unlock(addressID string) {
+	locks.Lock()
+	defer locks.Unlock()
+
+	delete(locks.addresses, addressID)
+}
+
+var errQuit = errors.New("quit")
+
+type conn struct {
+	server *Server
+	c      net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	// What USER was given, until PASS
+	username string
+
+	// Set once logged in
+	address  *db.Address
+	messages []db.Email
+	deleted  []bool
+}
+
+func (s *Server) handle(c net.Conn) {
+	cn := &conn{
+		server: s,
+		c:      c,
+		r:      bufio.NewReader(c),
+		w:      bufio.NewWriter(c),
+	}
+
+	cn.serve()
+}
+
+// Talks to the client until it quits or goes away
+func (c *conn) serve() {
+	defer c.c.Close()
+	defer func() {
+		if c.address != nil {
+			unlock(c.address.ID)
+		}
+	}()
+
+	c.writef("+OK temp-email POP3 server ready")
+	c.w.Flush()
+
+	for {
+		c.c.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		line, err := c.readLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			c.writef("-ERR Empty command")
+			c.w.Flush()
+			continue
+		}
+
+		// PASS is special, since passwords can have spaces in them
+		var args []string
+		if strings.EqualFold(fields[0], "PASS") {
+			args = []string{strings.TrimPrefix(line, fields[0]+" ")}
+		} else {
+			args = fields[1:]
+		}
+
+		err = c.run(strings.ToUpper(fields[0]), args)
+		if err == errQuit {
+			c.w.Flush()
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.writef("-ERR Something went wrong, try again later")
+		}
+
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func (c *conn) writef(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format, args...)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) run(name string, args []string) error {
+	switch name {
+	case "CAPA":
+		c.writef("+OK Capability list follows")
+		// App passwords never go over the wire unencrypted, so USER only
+		// shows up once there's TLS (RFC 2595 section 4)
+		if c.isTLS() {
+			c.writef("USER")
+		}
+		c.writef("UIDL")
+		c.writef("TOP")
+		c.writef("RESP-CODES")
+		c.writef("AUTH-RESP-CODE")
+		if c.server.TLSConfig != nil && !c.isTLS() && c.address == nil {
+			c.writef("STLS")
+		}
+		if c.isTLS() {
+			c.writef("IMPLEMENTATION temp-email")
+		} else {
+			c.writef("IMPLEMENTATION temp-email (log in over TLS)")
+		}
+		c.writef(".")
+		return nil
+	case "QUIT":
+		return c.quit()
+	}
+
+	if c.address == nil {
+		switch name {
+		case "STLS":
+			return c.startTLS()
+		case "USER", "PASS", "APOP":
+			if !c.isTLS() {
+				c.writef("-ERR [AUTH] Use STLS or the TLS port to log in")
+				return nil
+			}
+		}
+
+		switch name {
+		case "USER":
+			if len(args) != 1 {
+				c.writef("-ERR Expected a username")
+				return nil
+			}
+			c.username = args[0]
+			c.writef("+OK Send your password")
+			return nil
+		case "PASS":
+			return c.login(args[0])
+		case "APOP":
+			c.writef("-ERR APOP isn't supported, use USER and PASS")
+			return nil
+		}
+
+		c.writef("-ERR Log in first")
+		return nil
+	}
+
+	switch name {
+	case "STAT":
+		count, size := 0, 0
+		for i := range c.messages {
+			if !c.deleted[i] {
+				count++
+				size += c.size(i)
+			}
+		}
+		c.writef("+OK %d %d", count, size)
+	case "LIST", "UIDL":
+		return c.list(name, args)
+	case "RETR":
+		i, ok := c.message(args, 1)
+		if !ok {
+			return nil
+		}
+
+		c.writef("+OK %d octets", c.size(i))
+		c.writeMultiline(mailbox.Raw(c.messages[i]))
+	case "TOP":
+		i, ok := c.message(args, 2)
+		if !ok {
+			return nil
+		}
+		lines, err := strconv.Atoi(args[1])
+		if err != nil || lines < 0 {
+			c.writef("-ERR Invalid number of lines")
+			return nil
+		}
+
+		c.writef("+OK Top of message follows")
+		c.writeMultiline(top(mailbox.Raw(c.messages[i]), lines))
+	case "DELE":
+		i, ok := c.message(args, 1)
+		if !ok {
+			return nil
+		}
+
+		c.deleted[i] = true
+		c.writef("+OK Message %d deleted", i+1)
+	case "RSET":
+		for i := range c.deleted {
+			c.deleted[i] = false
+		}
+		c.writef("+OK Deleted messages restored")
+	case "NOOP":
+		c.writef("+OK")
+	case "USER", "PASS", "APOP", "STLS":
+		c.writef("-ERR Already logged in")
+	default:
+		c.writef("-ERR Unknown command")
+	}
+
+	return nil
+}
+
+func (c *conn) startTLS() error {
+	if c.server.TLSConfig == nil || c.isTLS() {
+		c.writef("-ERR STLS not available")
+		return nil
+	}
+
+	c.writef("+OK Begin TLS negotiation")
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(c.c, c.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return errQuit
+	}
+
+	c.c = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	c.w = bufio.NewWriter(tlsConn)
+	return nil
+}
+
+func (c *conn) login(password string) error {
+	if c.username == "" {
+		c.writef("-ERR Send USER first")
+		return nil
+	}
+	username := c.username
+	c.username = ""
+
+	address, err := mailbox.Authenticate(username, password)
+	if err == mailbox.ErrInvalidCredentials {
+		// Slow down anyone guessing passwords
+		time.Sleep(time.Second)
+		c.writef("-ERR [AUTH] Invalid credentials")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !lock(address.ID) {
+		c.writef("-ERR [IN-USE] Maildrop is already open somewhere else")
+		return nil
+	}
+
+	messages, err := mailbox.Messages(address)
+	if err != nil {
+		unlock(address.ID)
+		return err
+	}
+
+	c.address = &address
+	c.messages = messages
+	c.deleted = make([]bool, len(messages))
+
+	c.writef("+OK Maildrop has %d messages", len(messages))
+	return nil
+}
+
+// Deletes whatever was marked for deletion, if logged in, and says goodbye
+func (c *conn) quit() error {
+	if c.address != nil {
+		var ids []string
+		for i, m := range c.messages {
+			if c.deleted[i] {
+				ids = append(ids, m.ID)
+			}
+		}
+
+		if err := mailbox.Delete(ids); err != nil {
+			log.Println(err)
+			c.writef("-ERR Some deleted messages not removed")
+			return errQuit
+		}
+	}
+
+	c.writef("+OK Bye")
+	return errQuit
+}
+
+func (c *conn) size(i int) int {
+	return len(mailbox.Raw(c.messages[i]))
+}
+
+// Finds the message a command's first argument refers to, as an index into
+// c.messages. It writes the error response itself.
+func (c *conn) message(args []string, want int) (int, bool) {
+	if len(args) != want {
+		c.writef("-ERR Wrong number of arguments")
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(c.messages) {
+		c.writef("-ERR No such message")
+		return 0, false
+	}
+	if c.deleted[n-1] {
+		c.writef("-ERR Message %d already deleted", n)
+		return 0, false
+	}
+
+	return n - 1, true
+}
+
+// Handles LIST and UIDL, which both list something about each message
+func (c *conn) list(name string, args []string) error {
+	describe := func(i int) string {
+		if name == "UIDL" {
+			return fmt.Sprintf("%d %s", i+1, c.messages[i].ID)
+		}
+		return fmt.Sprintf("%d %d", i+1, c.size(i))
+	}
+
+	if len(args) > 0 {
+		i, ok := c.message(args, 1)
+		if ok {
+			c.writef("+OK %s", describe(i))
+		}
+		return nil
+	}
+
+	c.writef("+OK Listing follows")
+	for i := range c.messages {
+		if !c.deleted[i] {
+			c.writef("%s", describe(i))
+		}
+	}
+	c.writef(".")
+	return nil
+}
+
+// Writes a multi-line response, dot-stuffing it and adding the final "."
+func (c *conn) writeMultiline(data []byte) {
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		var line []byte
+		if end < 0 {
+			line, data = data, nil
+		} else {
+			line, data = data[:end], data[end+2:]
+		}
+
+		if bytes.HasPrefix(line, []byte(".")) {
+			c.w.WriteByte('.')
+		}
+		c.w.Write(line)
+		c.w.WriteString("\r\n")
+	}
+
+	c.writef(".")
+}
+
+// The header and the first n lines of the body
+func top(raw []byte, n int) []byte {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return raw
+	}
+
+	body := raw[end+4:]
+	for i := 0; i < n; i++ {
+		next := bytes.Index(body, []byte("\r\n"))
+		if next < 0 {
+			return raw
+		}
+		body = body[next+2:]
+	}
+
+	return raw[:len(raw)-len(body)]
+}
@@ -0,0 +1,218 @@
+package pop3
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/internal/mailtest"
+)
+
+// The client end of a session
+type client struct {
+	*mailtest.Client
+}
+
+// Starts a session over a pipe, with the server's connection set up by
+// prepare before it starts talking
+func startSession(t *testing.T, server *Server, prepare func(*conn)) *client {
+	serverConn, cl := mailtest.Pipe(t)
+
+	c := &conn{
+		server: server,
+		c:      serverConn,
+		r:      bufio.NewReader(serverConn),
+		w:      bufio.NewWriter(serverConn),
+	}
+	if prepare != nil {
+		prepare(c)
+	}
+	go c.serve()
+
+	if greeting := cl.ReadLine(); !strings.HasPrefix(greeting, "+OK") {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	return &client{cl}
+}
+
+func (cl *client) send(command string) {
+	cl.T.Helper()
+
+	cl.Write(command + "\r\n")
+}
+
+// Sends a command and checks its single-line response starts with want
+func (cl *client) expect(command, want string) {
+	cl.T.Helper()
+
+	cl.send(command)
+	if got := cl.ReadLine(); !strings.HasPrefix(got, want) {
+		cl.T.Errorf("%s: got %q, want %q", command, got, want)
+	}
+}
+
+// Sends a command with a multi-line response, returning the lines between
+// the status and the final "." exactly as they were sent
+func (cl *client) expectMultiline(command string) []string {
+	cl.T.Helper()
+
+	cl.send(command)
+	if status := cl.ReadLine(); !strings.HasPrefix(status, "+OK") {
+		cl.T.Fatalf("%s: got %q", command, status)
+	}
+
+	var lines []string
+	for {
+		line := cl.ReadLine()
+		if line == "." {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func equal(a, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+func TestPlaintextLoginRefused(t *testing.T) {
+	cl := startSession(t, &Server{TLSConfig: mailtest.TLSConfig(t)}, nil)
+
+	caps := strings.Join(cl.expectMultiline("CAPA"), "\n")
+	if strings.Contains(caps, "USER") || !strings.Contains(caps, "STLS") || !strings.Contains(caps, "log in over TLS") {
+		t.Errorf("unexpected capabilities without TLS:\n%s", caps)
+	}
+
+	cl.expect("USER someone@example.com", "-ERR [AUTH]")
+	cl.expect("PASS hunter2", "-ERR [AUTH]")
+	cl.expect("APOP someone@example.com c4c9334bac560ecc979e58001b3e22fb", "-ERR [AUTH]")
+	cl.expect("STAT", "-ERR")
+
+	cl.expect("STLS", "+OK")
+	cl.StartTLS()
+
+	caps = strings.Join(cl.expectMultiline("CAPA"), "\n")
+	if !strings.Contains(caps, "USER") || strings.Contains(caps, "STLS") || strings.Contains(caps, "log in over TLS") {
+		t.Errorf("unexpected capabilities after STLS:\n%s", caps)
+	}
+
+	cl.expect("STLS", "-ERR")
+	cl.expect("APOP someone@example.com c4c9334bac560ecc979e58001b3e22fb", "-ERR APOP isn't supported")
+	cl.expect("USER", "-ERR Expected a username")
+	cl.expect("PASS hunter2", "-ERR Send USER first")
+	cl.expect("QUIT", "+OK")
+}
+
+func TestNoLoginWithoutTLS(t *testing.T) {
+	cl := startSession(t, &Server{}, nil)
+
+	caps := strings.Join(cl.expectMultiline("CAPA"), "\n")
+	if strings.Contains(caps, "STLS") || strings.Contains(caps, "USER") {
+		t.Errorf("unexpected capabilities:\n%s", caps)
+	}
+	cl.expect("STLS", "-ERR")
+	cl.expect("USER someone@example.com", "-ERR [AUTH]")
+}
+
+func TestSession(t *testing.T) {
+	address := &db.Address{ID: "pop3-session-test", Domain: "temp.test"}
+
+	cl := startSession(t, &Server{}, func(c *conn) {
+		// Logged in, without a database
+		if !lock(address.ID) {
+			t.Fatal("address already locked")
+		}
+		c.address = address
+		c.messages = []db.Email{
+			{ID: "first", Content: "Subject: one\r\n\r\nhello\r\n"},
+			// Stored with bare LFs, and a line that needs dot-stuffing
+			{ID: "second", Content: "Subject: two\n\nline 1\nline 2\n.hidden\nline 4\n"},
+			{ID: "third", Content: "Subject: three\r\n\r\n"},
+		}
+		c.deleted = make([]bool, len(c.messages))
+	})
+
+	cl.expect("STAT", "+OK 3 90")
+	if got := cl.expectMultiline("LIST"); !equal(got, []string{"1 23", "2 49", "3 18"}) {
+		t.Errorf("LIST: %q", got)
+	}
+	cl.expect("LIST 2", "+OK 2 49")
+	cl.expect("LIST 4", "-ERR No such message")
+	if got := cl.expectMultiline("UIDL"); !equal(got, []string{"1 first", "2 second", "3 third"}) {
+		t.Errorf("UIDL: %q", got)
+	}
+	cl.expect("UIDL 3", "+OK 3 third")
+
+	if got := cl.expectMultiline("TOP 2 0"); !equal(got, []string{"Subject: two", ""}) {
+		t.Errorf("TOP 2 0: %q", got)
+	}
+	if got := cl.expectMultiline("TOP 2 1"); !equal(got, []string{"Subject: two", "", "line 1"}) {
+		t.Errorf("TOP 2 1: %q", got)
+	}
+	if got := cl.expectMultiline("TOP 2 100"); !equal(got, []string{"Subject: two", "", "line 1", "line 2", "..hidden", "line 4"}) {
+		t.Errorf("TOP 2 100: %q", got)
+	}
+	cl.expect("TOP 2", "-ERR")
+	cl.expect("TOP 2 -1", "-ERR")
+
+	if got := cl.expectMultiline("RETR 1"); !equal(got, []string{"Subject: one", "", "hello"}) {
+		t.Errorf("RETR 1: %q", got)
+	}
+
+	cl.expect("DELE 1", "+OK")
+	cl.expect("DELE 1", "-ERR Message 1 already deleted")
+	cl.expect("RETR 1", "-ERR Message 1 already deleted")
+	cl.expect("DELE 3", "+OK")
+	cl.expect("STAT", "+OK 1 49")
+	if got := cl.expectMultiline("LIST"); !equal(got, []string{"2 49"}) {
+		t.Errorf("LIST after DELE: %q", got)
+	}
+	if got := cl.expectMultiline("UIDL"); !equal(got, []string{"2 second"}) {
+		t.Errorf("UIDL after DELE: %q", got)
+	}
+
+	cl.expect("RSET", "+OK")
+	cl.expect("STAT", "+OK 3 90")
+	cl.expect("USER someone", "-ERR Already logged in")
+	cl.expect("NOOP", "+OK")
+	cl.expect("FOO", "-ERR Unknown command")
+
+	// Nothing's marked deleted anymore, so quitting doesn't need the database
+	cl.expect("QUIT", "+OK Bye")
+
+	cl.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cl.R.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after QUIT: %v", err)
+	}
+	if !lock(address.ID) {
+		t.Error("maildrop still locked after QUIT")
+	}
+	unlock(address.ID)
+}
+
+func TestTop(t *testing.T) {
+	raw := []byte("Subject: hi\r\n\r\none\r\ntwo\r\n")
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "Subject: hi\r\n\r\n"},
+		{1, "Subject: hi\r\n\r\none\r\n"},
+		{2, "Subject: hi\r\n\r\none\r\ntwo\r\n"},
+		{5, "Subject: hi\r\n\r\none\r\ntwo\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(top(raw, tt.n)); got != tt.want {
+			t.Errorf("top(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+
+	if got := string(top([]byte("Subject: no body"), 1)); got != "Subject: no body" {
+		t.Errorf("top without a body = %q", got)
+	}
+}
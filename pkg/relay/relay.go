@@ -0,0 +1,133 @@
+// Package relay sends mail out through an SMTP relay, which is how replies
+// written in Slack reach whoever sent the original email
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"os"
+	"time"
+)
+
+var ErrNoTLS = errors.New("relay doesn't support STARTTLS")
+
+// How long a whole conversation with the relay can take
+const timeout = 2 * time.Minute
+
+type Relay struct {
+	// host:port, e.g. smtp.example.com:587, or localhost:1025 for a fake
+	// SMTP sink while testing
+	Addr string
+
+	// Optional, for relays that want you to log in
+	Username string
+	Password string
+
+	// Connect with TLS right away (usually port 465) instead of using
+	// STARTTLS when the relay offers it
+	ImplicitTLS bool
+
+	// Give up instead of sending in the clear when the relay doesn't offer
+	// STARTTLS
+	RequireTLS bool
+
+	// What to introduce ourselves as
+	Hostname string
+}
+
+// FromEnv configures a relay from the SMTP_RELAY_* variables, returning nil
+// if there isn't one
+func FromEnv() *Relay {
+	if os.Getenv("SMTP_RELAY_ADDR") == "" {
+		return nil
+	}
+
+	return &Relay{
+		Addr:        os.Getenv("SMTP_RELAY_ADDR"),
+		Username:    os.Getenv("SMTP_RELAY_USERNAME"),
+		Password:    os.Getenv("SMTP_RELAY_PASSWORD"),
+		ImplicitTLS: os.Getenv("SMTP_RELAY_TLS") == "true",
+		RequireTLS:  os.Getenv("SMTP_RELAY_REQUIRE_TLS") == "true",
+		Hostname:    os.Getenv("DOMAIN"),
+	}
+}
+
+// Send delivers a message to the relay
+func (r *Relay) Send(from string, to []string, msg []byte) error {
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if r.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.Addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", r.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if r.Hostname != "" {
+		if err := c.Hello(r.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if !r.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if r.RequireTLS {
+			return ErrNoTLS
+		}
+	}
+
+	// PlainAuth refuses to send the password unencrypted, unless the relay
+	// is on localhost
+	if r.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", r.Username, r.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
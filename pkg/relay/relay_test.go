@@ -0,0 +1,269 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/emersion/go-smtp"
+)
+
+// A fake SMTP server that keeps whatever it's sent
+type sink struct {
+	mu       sync.Mutex
+	messages []sunk
+}
+
+type sunk struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+type sinkSession struct {
+	sink *sink
+	msg  sunk
+}
+
+func (s *sink) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (s *sink) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &sinkSession{sink: s}, nil
+}
+
+func (s *sinkSession) Reset()        { s.msg = sunk{} }
+func (s *sinkSession) Logout() error { return nil }
+
+func (s *sinkSession) Mail(from string, opts smtp.MailOptions) error {
+	s.msg.From = from
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string) error {
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = data
+
+	s.sink.mu.Lock()
+	s.sink.messages = append(s.sink.messages, s.msg)
+	s.sink.mu.Unlock()
+	return nil
+}
+
+// Starts a sink on a random local port, returning its address
+func startSink(t *testing.T) (*sink, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sink{}
+	srv := smtp.NewServer(s)
+	srv.Domain = "sink.test"
+	srv.ReadTimeout = 5 * time.Second
+	srv.WriteTimeout = 5 * time.Second
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return s, l.Addr().String()
+}
+
+func addresses(t *testing.T, list string) []*mail.Address {
+	t.Helper()
+
+	parsed, err := mail.ParseAddressList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSendReply(t *testing.T) {
+	s, addr := startSink(t)
+
+	original := parsemail.Email{
+		From:       addresses(t, "Alice <alice@example.com>"),
+		ReplyTo:    addresses(t, "Support <support@example.com>, bob@example.org"),
+		Subject:    "Your order\r\nBcc: victim@example.net",
+		MessageID:  "order-3@example.com",
+		References: []string{"order-1@example.com", "order-2@example.com"},
+		TextBody:   "Thanks for your order!",
+		Date:       time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+
+	reply, err := NewReply("abc@temp.test", original, "Where is it?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Relay{Addr: addr, Hostname: "temp.test"}
+	if err := r.Send(reply.From, reply.To, reply.Message); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.messages) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(s.messages))
+	}
+	got := s.messages[0]
+
+	if got.From != "abc@temp.test" {
+		t.Errorf("MAIL FROM %q, want the temp address", got.From)
+	}
+	if strings.Join(got.To, ",") != "support@example.com,bob@example.org" {
+		t.Errorf("RCPT TO %v, want the Reply-To addresses", got.To)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(got.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"From":        "<abc@temp.test>",
+		"To":          `"Support" <support@example.com>, <bob@example.org>`,
+		"Subject":     "Re: Your order Bcc: victim@example.net",
+		"In-Reply-To": "<order-3@example.com>",
+		"References":  "<order-1@example.com> <order-2@example.com> <order-3@example.com>",
+	} {
+		if value := strings.Join(strings.Fields(msg.Header.Get(name)), " "); value != want {
+			t.Errorf("%s: %q, want %q", name, value, want)
+		}
+	}
+	if bcc := msg.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("subject injected a Bcc header: %q", bcc)
+	}
+
+	body, _ := ioutil.ReadAll(msg.Body)
+	if !strings.Contains(string(body), "Where is it?") || !strings.Contains(string(body), "> Thanks for your order!") {
+		t.Errorf("unexpected body:\n%s", body)
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		original parsemail.Email
+		to       string
+		headers  map[string]string
+	}{
+		{
+			name:     "falls back to From",
+			original: parsemail.Email{From: addresses(t, "alice@example.com"), Subject: "Re: hi", MessageID: "1@example.com"},
+			to:       "alice@example.com",
+			headers: map[string]string{
+				"Subject":     "Re: hi",
+				"In-Reply-To": "<1@example.com>",
+				"References":  "<1@example.com>",
+			},
+		},
+		{
+			name: "uses In-Reply-To without References",
+			original: parsemail.Email{
+				From:      addresses(t, "alice@example.com"),
+				Subject:   "hi",
+				MessageID: "2@example.com",
+				InReplyTo: []string{"1@example.com"},
+			},
+			to: "alice@example.com",
+			headers: map[string]string{
+				"Subject":    "Re: hi",
+				"References": "<1@example.com> <2@example.com>",
+			},
+		},
+		{
+			name: "no message ID",
+			original: parsemail.Email{
+				From:    addresses(t, "alice@example.com"),
+				Subject: "hi\nX-Injected: yes",
+			},
+			to: "alice@example.com",
+			headers: map[string]string{
+				"In-Reply-To": "",
+				"References":  "",
+				"X-Injected":  "",
+			},
+		},
+		{
+			name: "message IDs can't inject headers",
+			original: parsemail.Email{
+				From:       addresses(t, "alice@example.com"),
+				MessageID:  "1@example.com>\r\nX-Injected: yes",
+				References: []string{"0@example.com", "x>\r\nX-Injected: yes"},
+			},
+			to: "alice@example.com",
+			headers: map[string]string{
+				"In-Reply-To": "",
+				"X-Injected":  "",
+			},
+		},
+		{
+			name: "injected display name",
+			original: parsemail.Email{
+				From: []*mail.Address{{Name: "Eve\r\nBcc: victim@example.net", Address: "eve@example.com"}},
+			},
+			to: "eve@example.com",
+			headers: map[string]string{
+				"Bcc": "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := NewReply("abc@temp.test", tt.original, "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(reply.To, ",") != tt.to {
+				t.Errorf("recipients %v, want %s", reply.To, tt.to)
+			}
+
+			msg, err := mail.ReadMessage(bytes.NewReader(reply.Message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.headers {
+				if value := strings.Join(strings.Fields(msg.Header.Get(name)), " "); value != want {
+					t.Errorf("%s: %q, want %q", name, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNoRecipient(t *testing.T) {
+	if _, err := NewReply("abc@temp.test", parsemail.Email{Subject: "hi"}, "hello"); err != ErrNoRecipient {
+		t.Errorf("got %v, want ErrNoRecipient", err)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	s, addr := startSink(t)
+
+	r := &Relay{Addr: addr, RequireTLS: true}
+	if err := r.Send("abc@temp.test", []string{"alice@example.com"}, []byte("Subject: hi\r\n\r\nhi\r\n")); err != ErrNoTLS {
+		t.Errorf("got %v, want ErrNoTLS", err)
+	}
+	if len(s.messages) != 0 {
+		t.Errorf("message was sent in the clear")
+	}
+}
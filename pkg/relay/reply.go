@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/ids"
+)
+
+var ErrNoRecipient = errors.New("nobody to reply to")
+
+// A reply to an email, ready to Send
+type Reply struct {
+	From    string
+	To      []string
+	Message []byte
+}
+
+// NewReply writes a plain text reply to an email, sent from the address it
+// was received at. It threads properly in the recipient's mail client, and
+// quotes the original text below the reply.
+func NewReply(from string, original parsemail.Email, body string) (Reply, error) {
+	recipients := original.ReplyTo
+	if len(recipients) == 0 {
+		recipients = original.From
+	}
+	if len(recipients) == 0 {
+		return Reply{}, ErrNoRecipient
+	}
+
+	var to []string
+	var toHeader []string
+	for _, r := range recipients {
+		to = append(to, r.Address)
+		toHeader = append(toHeader, r.String())
+	}
+
+	subject := strings.Join(strings.Fields(original.Subject), " ")
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	domain := from
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+
+	header("From", (&mail.Address{Address: from}).String())
+	header("To", strings.Join(toHeader, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", ids.Token(), domain))
+
+	// References is the original's references plus the original itself, or
+	// what it was replying to if it didn't have any
+	if validID(original.MessageID) {
+		references := original.References
+		if len(references) == 0 {
+			references = original.InReplyTo
+		}
+
+		var refs []string
+		for _, id := range append(references, original.MessageID) {
+			if validID(id) {
+				refs = append(refs, "<"+id+">")
+			}
+		}
+
+		header("In-Reply-To", "<"+original.MessageID+">")
+		header("References", strings.Join(refs, "\r\n "))
+	}
+
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(replyText(original, body), "\n", "\r\n")))
+	w.Close()
+
+	return Reply{From: from, To: to, Message: b.Bytes()}, nil
+}
+
+// Message IDs get copied into our headers, so anything that could break out
+// of them is left out
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r == '<' || r == '>' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// The reply followed by the quoted original, like mail clients do it
+func replyText(original parsemail.Email, body string) string {
+	body = strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n")) + "\n"
+
+	quoted := strings.TrimSpace(strings.ReplaceAll(original.TextBody, "\r\n", "\n"))
+	if quoted == "" || len(original.From) == 0 {
+		return body
+	}
+
+	var b strings.Builder
+	b.WriteString(body)
+	fmt.Fprintf(&b, "\nOn %s, %s wrote:\n", original.Date.Format("Mon, 2 Jan 2006 at 15:04"), original.From[0].String())
+	for _, line := range strings.Split(quoted, "\n") {
+		if line == "" || strings.HasPrefix(line, ">") {
+			b.WriteString(">" + line + "\n")
+		} else {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,132 @@
+// Package safehttp makes outgoing requests to URLs that users or senders
+// picked, without letting them reach anything on the local network
+package safehttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedHost = errors.New("refusing to connect to a private address")
+	ErrInvalidURL  = errors.New("needs an http(s) URL")
+)
+
+// Client is shared by everything that sends to user-supplied URLs, like
+// webhooks and notifiers
+var Client = NewClient(false)
+
+var privateBlocks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this network", which Linux connects to as loopback
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"fc00::/7",       // unique local
+	} {
+		_, block, _ := net.ParseCIDR(cidr)
+		privateBlocks = append(privateBlocks, block)
+	}
+}
+
+// NewClient returns an HTTP client that, unless allowPrivate is set, refuses
+// to connect anywhere on the local network. The check happens when
+// connecting, so redirects and DNS tricks can't get around it.
+func NewClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = Guard
+	}
+
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("unsupported redirect")
+			}
+			return nil
+		},
+	}
+}
+
+// Guard is a net.Dialer Control function that refuses to connect to private
+// addresses
+func Guard(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || IsPrivate(ip) {
+		return ErrBlockedHost
+	}
+	return nil
+}
+
+// IsPrivate reports whether ip is loopback, link-local, multicast or in one
+// of the private ranges
+func IsPrivate(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, block := range privateBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL makes sure a URL is http(s) and points somewhere public, so
+// obviously bad ones are turned away when they're saved instead of failing
+// on every delivery
+func CheckURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, ErrInvalidURL
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, ErrBlockedHost
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if IsPrivate(ip) {
+			return nil, ErrBlockedHost
+		}
+		return u, nil
+	}
+
+	// Names that don't resolve yet are let through, the client checks again
+	// when it connects anyway
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return u, nil
+	}
+	for _, ip := range ips {
+		if IsPrivate(ip) {
+			return nil, ErrBlockedHost
+		}
+	}
+
+	return u, nil
+}
@@ -0,0 +1,85 @@
+package safehttp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"10.20.30.40", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.0.0.8", true},
+		{"192.168.1.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd12:3456::1", true},
+		{"ff02::1", true},
+		// Mapped addresses reach the same IPv4 hosts
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:198.18.0.1", true},
+
+		{"1.1.1.1", false},
+		{"8.8.8.8", false},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		{"172.15.255.255", false},
+		{"172.32.0.1", false},
+		{"192.0.1.1", false},
+		{"192.0.2.1", false},
+		{"198.17.255.255", false},
+		{"198.20.0.1", false},
+		{"2606:4700:4700::1111", false},
+		{"::ffff:1.1.1.1", false},
+	}
+
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("couldn't parse %s", tt.ip)
+		}
+		if got := IsPrivate(ip); got != tt.want {
+			t.Errorf("IsPrivate(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"https://1.1.1.1/hook", nil},
+		{"http://[2606:4700:4700::1111]:8080/hook", nil},
+		{"ftp://1.1.1.1/hook", ErrInvalidURL},
+		{"https:///hook", ErrInvalidURL},
+		{"not a url", ErrInvalidURL},
+		{"http://localhost:8080", ErrBlockedHost},
+		{"http://api.LOCALHOST./", ErrBlockedHost},
+		{"http://0.0.0.0:8080", ErrBlockedHost},
+		{"http://198.18.0.1", ErrBlockedHost},
+		{"http://[::ffff:192.168.0.1]/", ErrBlockedHost},
+	}
+
+	for _, tt := range tests {
+		if _, err := CheckURL(tt.url); err != tt.want {
+			t.Errorf("CheckURL(%q) = %v, want %v", tt.url, err, tt.want)
+		}
+	}
+}
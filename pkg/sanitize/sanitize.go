@@ -0,0 +1,404 @@
+// Package sanitize makes HTML from incoming email safe to show in a browser
+package sanitize
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+type Options struct {
+	// Keep references to images on other servers. Off by default, since
+	// loading them tells the sender the email was opened.
+	AllowRemoteImages bool
+
+	// If set, remote image URLs that are kept get passed through this, e.g.
+	// to point them at a proxy. An empty result drops the image.
+	RewriteURL func(string) string
+
+	// Turns a cid: reference to one of the email's own parts into a URL it
+	// can be loaded from. An empty result drops the image.
+	RewriteCID func(string) string
+}
+
+type Result struct {
+	HTML string
+
+	// How many remote images were stripped
+	BlockedImages int
+}
+
+// Removed along with everything inside them
+var droppedElements = map[string]bool{
+	"script":   true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"base":     true,
+	"meta":     true,
+	"link":     true,
+	"input":    true,
+	"button":   true,
+	"select":   true,
+	"textarea": true,
+	"template": true,
+	"portal":   true,
+
+	// SVG animations can set href to a javascript: URL after we've checked it
+	"animate":          true,
+	"animatemotion":    true,
+	"animatetransform": true,
+	"set":              true,
+}
+
+// Removed, but their contents are kept
+var unwrappedElements = map[string]bool{
+	"form":     true,
+	"noscript": true,
+}
+
+// Always removed, no matter what they contain
+var droppedAttributes = map[string]bool{
+	"action":     true,
+	"formaction": true,
+	"srcdoc":     true,
+	"ping":       true,
+	"http-equiv": true,
+}
+
+// Attributes holding a URL, which have their scheme checked
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"background": true,
+	"poster":     true,
+	"cite":       true,
+	"longdesc":   true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+	"usemap":     true,
+	"xlink:href": true,
+}
+
+// Attributes that make the browser load something as soon as the page opens
+var loadingAttributes = map[string]bool{
+	"src":        true,
+	"srcset":     true,
+	"background": true,
+	"poster":     true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+}
+
+var (
+	// Matches CSS url() references, e.g. url("https://example.com/bg.png"),
+	// or failing that just the "url(" of one we can't make sense of
+	cssURLPattern = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)|url\(`)
+
+	// Other ways CSS can load things or run code
+	cssBlockedPattern = regexp.MustCompile(`(?i)@import|expression\s*\(|-moz-binding|behavior\s*:|image-set\s*\(|image\s*\(|cross-fade\s*\(|element\s*\(`)
+
+	cssCommentPattern = regexp.MustCompile(`(?s)/\*.*?\*/|/\*.*$`)
+
+	// Escapes of letters, digits, - and _, which can spell out any of the
+	// above, e.g. u\72l(
+	cssEscapePattern = regexp.MustCompile(`\\([0-9a-fA-F]{1,6})[ \t\r\n\f]?|\\([a-zA-Z_-])`)
+)
+
+// HTML parses body and returns a copy with anything that could run code,
+// submit data or load remote content stripped out.
+func HTML(body string, opts Options) (Result, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	clean(doc, opts, &result)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return Result{}, err
+	}
+
+	result.HTML = buf.String()
+	return result, nil
+}
+
+func clean(n *html.Node, opts Options, result *Result) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+
+		switch c.Type {
+		case html.CommentNode:
+			// Conditional comments can hide markup from us
+			n.RemoveChild(c)
+		case html.ElementNode:
+			name := strings.ToLower(c.Data)
+
+			if droppedElements[name] {
+				n.RemoveChild(c)
+				break
+			}
+
+			if name == "style" {
+				for gc := c.FirstChild; gc != nil; gc = gc.NextSibling {
+					if gc.Type == html.TextNode {
+						// Style contents are written out as is, so they
+						// mustn't be able to close the element
+						gc.Data = strings.ReplaceAll(cleanCSS(gc.Data, opts, result), "<", `\3c `)
+					}
+				}
+			}
+
+			cleanAttributes(c, opts, result)
+			clean(c, opts, result)
+
+			if unwrappedElements[name] {
+				for gc := c.FirstChild; gc != nil; {
+					gcNext := gc.NextSibling
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+					gc = gcNext
+				}
+				n.RemoveChild(c)
+			}
+		default:
+			clean(c, opts, result)
+		}
+
+		c = next
+	}
+}
+
+func cleanAttributes(n *html.Node, opts Options, result *Result) {
+	var attrs []html.Attribute
+	blocked := false
+
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" {
+			key = strings.ToLower(attr.Namespace) + ":" + key
+		}
+
+		if strings.HasPrefix(key, "on") || droppedAttributes[key] {
+			continue
+		}
+
+		if urlAttributes[key] {
+			scheme := urlScheme(attr.Val)
+			if !allowedScheme(scheme, n.Data, key, attr.Val) {
+				continue
+			}
+			if loadingAttributes[key] && scheme == "cid" {
+				if attr.Val = rewriteCID(attr.Val, opts); attr.Val == "" {
+					continue
+				}
+			} else if loadingAttributes[key] && isRemote(attr.Val, scheme) {
+				if !opts.AllowRemoteImages {
+					blocked = true
+					continue
+				}
+				if attr.Val = rewrite(attr.Val, opts); attr.Val == "" {
+					continue
+				}
+			}
+		}
+
+		if key == "style" {
+			attr.Val = cleanCSS(attr.Val, opts, result)
+		}
+
+		// srcset is a list of URLs, so only keep it when remote images are
+		// allowed, and even then only for plain web URLs
+		if key == "srcset" {
+			if !opts.AllowRemoteImages {
+				blocked = true
+				continue
+			}
+			if attr.Val = cleanSrcset(attr.Val, opts); attr.Val == "" {
+				continue
+			}
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	if blocked {
+		result.BlockedImages++
+	}
+
+	// Links open outside the viewer, without telling the other end where
+	// they came from
+	if n.Data == "a" {
+		attrs = setAttribute(attrs, "target", "_blank")
+		attrs = setAttribute(attrs, "rel", "noopener noreferrer")
+	}
+
+	n.Attr = attrs
+}
+
+// Browsers ignore whitespace and control characters in URLs, so
+// "java\tscript:" still runs
+func compact(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func urlScheme(value string) string {
+	u, err := url.Parse(compact(value))
+	if err != nil {
+		// Unparseable URLs get dropped
+		return "invalid"
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+func allowedScheme(scheme, element, attr, value string) bool {
+	switch scheme {
+	case "", "http", "https", "mailto", "tel", "cid":
+		return true
+	case "data":
+		// Inline images are fine, inline documents aren't
+		value = strings.ToLower(compact(value))
+		return element == "img" && attr == "src" && strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg")
+	default:
+		return false
+	}
+}
+
+// Browsers treat backslashes like slashes too, so \\example.com is remote
+func isRemote(value, scheme string) bool {
+	return scheme == "http" || scheme == "https" || strings.HasPrefix(strings.ReplaceAll(compact(value), `\`, "/"), "//")
+}
+
+func rewrite(value string, opts Options) string {
+	if opts.RewriteURL == nil {
+		return value
+	}
+	return opts.RewriteURL(value)
+}
+
+// Content IDs can be percent-encoded in cid: URLs (RFC 2392)
+func rewriteCID(value string, opts Options) string {
+	if opts.RewriteCID == nil {
+		return ""
+	}
+
+	value = compact(value)
+	cid, err := url.PathUnescape(value[strings.Index(value, ":")+1:])
+	if err != nil {
+		return ""
+	}
+	return opts.RewriteCID(strings.Trim(cid, "<>"))
+}
+
+// Keeps only the plain web URLs in a srcset, rewriting them as needed
+func cleanSrcset(value string, opts Options) string {
+	var candidates []string
+	for _, candidate := range strings.Split(value, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		if !isRemote(fields[0], urlScheme(fields[0])) {
+			continue
+		}
+
+		if fields[0] = rewrite(fields[0], opts); fields[0] == "" {
+			continue
+		}
+		candidates = append(candidates, strings.Join(fields, " "))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Deals with url() references in CSS the same way as image attributes, and
+// disables anything else that could load something
+func cleanCSS(css string, opts Options, result *Result) string {
+	// Comments and escapes could hide things from the patterns below
+	css = cssCommentPattern.ReplaceAllString(css, "")
+	css = cssEscapePattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssEscapePattern.FindStringSubmatch(match)
+		if groups[2] != "" {
+			return groups[2]
+		}
+		n, _ := strconv.ParseUint(groups[1], 16, 32)
+		if r := rune(n); r < utf8.RuneSelf && (r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return string(r)
+		}
+		return match
+	})
+
+	css = cssBlockedPattern.ReplaceAllStringFunc(css, func(match string) string {
+		if strings.HasPrefix(match, "@") {
+			return "@x-removed"
+		}
+		return "x-removed-" + match
+	})
+
+	return cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURLPattern.FindStringSubmatch(match)
+		value := groups[1] + groups[2] + groups[3]
+		scheme := urlScheme(value)
+
+		if !strings.HasSuffix(match, ")") {
+			// Not a url() we understand, so make sure the browser can't
+			// make sense of it either
+			return "x-removed("
+		}
+		if strings.Contains(value, `\`) {
+			return "none"
+		}
+
+		if scheme == "cid" {
+			if value = rewriteCID(value, opts); value == "" {
+				return "none"
+			}
+			return `url("` + cssEscape(value) + `")`
+		}
+
+		if isRemote(value, scheme) {
+			if !opts.AllowRemoteImages {
+				result.BlockedImages++
+				return "none"
+			}
+			if value = rewrite(value, opts); value == "" {
+				return "none"
+			}
+			return `url("` + cssEscape(value) + `")`
+		}
+
+		if !allowedScheme(scheme, "img", "src", value) {
+			return "none"
+		}
+		return match
+	})
+}
+
+func cssEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", "", "\r", "").Replace(value)
+}
+
+func setAttribute(attrs []html.Attribute, key, value string) []html.Attribute {
+	for i, attr := range attrs {
+		if attr.Namespace == "" && strings.ToLower(attr.Key) == key {
+			attrs[i].Val = value
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: key, Val: value})
+}
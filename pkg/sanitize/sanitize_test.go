@@ -0,0 +1,243 @@
+package sanitize
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Turns remote URLs into proxy URLs, like the viewer does
+func proxy(remote string) string {
+	if strings.Contains(remote, "drop-me") {
+		return ""
+	}
+	return "/proxy/image?url=" + url.QueryEscape(remote)
+}
+
+func cid(id string) string {
+	if id == "missing@example.com" {
+		return ""
+	}
+	return "/email/attachments/" + id
+}
+
+var remote = Options{AllowRemoteImages: true, RewriteURL: proxy, RewriteCID: cid}
+
+type test struct {
+	name  string
+	input string
+	opts  Options
+
+	// Strings the output must and mustn't contain, compared case-insensitively
+	want    []string
+	notWant []string
+
+	blocked int
+}
+
+func run(t *testing.T, tests []test) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := HTML(tt.input, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := strings.ToLower(result.HTML)
+
+			for _, w := range tt.want {
+				if !strings.Contains(out, strings.ToLower(w)) {
+					t.Errorf("output doesn't contain %q:\n%s", w, result.HTML)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(out, strings.ToLower(w)) {
+					t.Errorf("output contains %q:\n%s", w, result.HTML)
+				}
+			}
+			if result.BlockedImages != tt.blocked {
+				t.Errorf("BlockedImages = %d, want %d", result.BlockedImages, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestElements(t *testing.T) {
+	run(t, []test{
+		{name: "script", input: `<p>hi</p><script>alert(1)</script>`, want: []string{"<p>hi</p>"}, notWant: []string{"script", "alert"}},
+		{name: "uppercase script", input: `<SCRIPT>alert(1)</SCRIPT>`, notWant: []string{"script", "alert"}},
+		{name: "iframe", input: `<iframe src="https://example.com"></iframe>`, notWant: []string{"iframe", "example.com"}},
+		{name: "iframe srcdoc", input: `<iframe srcdoc="<script>alert(1)</script>"></iframe>`, notWant: []string{"iframe", "alert"}},
+		{name: "object", input: `<object data="evil.swf"><embed src="evil.swf"></object>`, notWant: []string{"object", "embed", "evil"}},
+		{name: "base", input: `<base href="https://evil.example/"><a href="/x">x</a>`, notWant: []string{"<base", "evil"}},
+		{name: "meta refresh", input: `<meta http-equiv="refresh" content="0;url=https://evil.example">`, notWant: []string{"<meta", "evil"}},
+		{name: "link", input: `<link rel="stylesheet" href="https://evil.example/a.css">`, notWant: []string{"<link", "evil"}},
+		{
+			name:    "form keeps its contents",
+			input:   `<form action="https://evil.example"><p>Enter your password</p><input type="password"><button formaction="https://evil.example">Go</button></form>`,
+			want:    []string{"<p>Enter your password</p>"},
+			notWant: []string{"<form", "<input", "<button", "action", "evil"},
+		},
+		{name: "svg animate", input: `<svg><a><animate attributeName="href" values="javascript:alert(1)"/><text>click</text></a></svg>`, want: []string{"click"}, notWant: []string{"animate", "javascript"}},
+		{name: "svg set", input: `<svg><a><set attributeName="href" to="javascript:alert(1)"/><text>click</text></a></svg>`, notWant: []string{"<set", "javascript"}},
+		{name: "conditional comment", input: `<!--[if gte mso 9]><script>alert(1)</script><![endif]--><p>hi</p>`, want: []string{"<p>hi</p>"}, notWant: []string{"script", "<!--"}},
+		{name: "template", input: `<template><img src=x onerror=alert(1)></template>`, notWant: []string{"template", "onerror"}},
+		{name: "noscript", input: `<noscript><p>plain</p></noscript>`, want: []string{"plain"}, notWant: []string{"noscript", "<p>"}},
+	})
+}
+
+func TestEventHandlers(t *testing.T) {
+	run(t, []test{
+		{name: "onerror", input: `<img src="cid:a@b" onerror="alert(1)">`, opts: remote, want: []string{"<img"}, notWant: []string{"onerror", "alert"}},
+		{name: "uppercase", input: `<body ONLOAD="alert(1)"><p>hi</p></body>`, notWant: []string{"onload", "alert"}},
+		{name: "svg", input: `<svg onload="alert(1)"><circle r="1"/></svg>`, want: []string{"<svg"}, notWant: []string{"onload", "alert"}},
+		{name: "no quotes", input: `<div onmouseover=alert(1)>x</div>`, want: []string{"<div>x</div>"}, notWant: []string{"alert"}},
+		{name: "ping", input: `<a href="https://example.com" ping="https://evil.example">x</a>`, want: []string{`href="https://example.com"`}, notWant: []string{"ping", "evil"}},
+	})
+}
+
+func TestLinks(t *testing.T) {
+	run(t, []test{
+		{name: "plain", input: `<a href="https://example.com">x</a>`, want: []string{`href="https://example.com"`, `target="_blank"`, `rel="noopener noreferrer"`}},
+		{name: "rel and target are overridden", input: `<a href="https://example.com" target="_top" rel="opener">x</a>`, want: []string{`target="_blank"`, `rel="noopener noreferrer"`}, notWant: []string{"_top", `"opener"`}},
+		{name: "mailto", input: `<a href="mailto:a@example.com">x</a>`, want: []string{`href="mailto:a@example.com"`}},
+		{name: "relative", input: `<a href="#section">x</a>`, want: []string{`href="#section"`}},
+		{name: "javascript", input: `<a href="javascript:alert(1)">x</a>`, notWant: []string{"javascript", "href"}},
+		{name: "mixed case", input: `<a href="JaVaScRiPt:alert(1)">x</a>`, notWant: []string{"javascript", "href"}},
+		{name: "leading whitespace", input: `<a href="  \t javascript:alert(1)">x</a>`, notWant: []string{"javascript", "href"}},
+		{name: "embedded tab", input: "<a href=\"java\tscript:alert(1)\">x</a>", notWant: []string{"script:", "href"}},
+		{name: "embedded newline", input: "<a href=\"java\nscript:alert(1)\">x</a>", notWant: []string{"script:", "href"}},
+		{name: "entity encoded", input: `<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">x</a>`, notWant: []string{"javascript", "href"}},
+		{name: "hex entities", input: `<a href="&#x6A;avascript&colon;alert(1)">x</a>`, notWant: []string{"javascript", "href"}},
+		{name: "entity encoded tab", input: `<a href="java&Tab;script:alert(1)">x</a>`, notWant: []string{"script:", "href"}},
+		{name: "vbscript", input: `<a href="vbscript:msgbox(1)">x</a>`, notWant: []string{"vbscript", "href"}},
+		{name: "data document", input: `<a href="data:text/html,<script>alert(1)</script>">x</a>`, notWant: []string{"data:", "href"}},
+		{name: "svg xlink", input: `<svg><a xlink:href="javascript:alert(1)"><text>x</text></a></svg>`, notWant: []string{"javascript"}},
+		{name: "math", input: `<math><maction actiontype="statusline" xlink:href="javascript:alert(1)">x</maction></math>`, notWant: []string{"javascript"}},
+	})
+}
+
+func TestImages(t *testing.T) {
+	run(t, []test{
+		{name: "remote blocked", input: `<img src="https://tracker.example/pixel.gif">`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "protocol relative blocked", input: `<img src="//tracker.example/pixel.gif">`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "backslashes blocked", input: `<img src="\\tracker.example/pixel.gif">`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "one count per element", input: `<img src="https://a.example/1.png" srcset="https://a.example/2.png 2x"><img src="https://a.example/3.png">`, notWant: []string{"a.example"}, blocked: 2},
+		{name: "background", input: `<table background="https://tracker.example/bg.png"><tr><td>x</td></tr></table>`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "video poster", input: `<video poster="https://tracker.example/p.png"></video>`, notWant: []string{"tracker"}, blocked: 1},
+		{
+			name:  "remote allowed",
+			input: `<img src="https://example.com/cat.png">`,
+			opts:  remote,
+			want:  []string{`src="/proxy/image?url=https%3a%2f%2fexample.com%2fcat.png"`},
+		},
+		{name: "rewrite can drop", input: `<img src="https://example.com/drop-me.png">`, opts: remote, notWant: []string{"src="}},
+		{name: "links aren't images", input: `<a href="https://example.com/cat.png">x</a>`, want: []string{`href="https://example.com/cat.png"`}},
+
+		{name: "data png", input: `<img src="data:image/png;base64,iVBORw0KGgo=">`, want: []string{`src="data:image/png;base64,ivborw0kggo="`}},
+		{name: "data gif uppercase", input: `<img src="DATA:image/gif;base64,R0lGOD=">`, want: []string{"data:image/gif"}},
+		{name: "data svg", input: `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, notWant: []string{"data:", "src="}},
+		{name: "data svg with tab", input: "<img src=\"data:image/sv\tg+xml;base64,PHN2Zz4=\">", notWant: []string{"data:", "src="}},
+		{name: "data svg uppercase", input: `<img src="data:IMAGE/SVG+XML,<svg onload=alert(1)>">`, notWant: []string{"data:", "alert"}},
+		{name: "data html in img", input: `<img src="data:text/html,<script>alert(1)</script>">`, notWant: []string{"data:", "alert"}},
+		{name: "data image outside img", input: `<video poster="data:image/png;base64,iVBORw0KGgo="></video>`, notWant: []string{"data:"}},
+		{name: "data image in link", input: `<a href="data:image/png;base64,iVBORw0KGgo=">x</a>`, notWant: []string{"data:"}},
+	})
+}
+
+func TestSrcset(t *testing.T) {
+	run(t, []test{
+		{name: "blocked", input: `<img srcset="https://a.example/1.png 1x, https://a.example/2.png 2x">`, notWant: []string{"srcset", "a.example"}, blocked: 1},
+		{
+			name:  "mixed",
+			input: `<img srcset="https://a.example/1.png 1x, javascript:alert(1) 2x, data:image/svg+xml,x 3x, //b.example/4.png 4x, drop-me.example 5x">`,
+			opts:  remote,
+			want: []string{
+				`/proxy/image?url=https%3a%2f%2fa.example%2f1.png 1x, /proxy/image?url=%2f%2fb.example%2f4.png 4x"`,
+			},
+			notWant: []string{"javascript", "data:", "2x", "3x", "5x"},
+		},
+		{name: "nothing left", input: `<img srcset="javascript:alert(1) 1x, cid:a@b 2x">`, opts: remote, notWant: []string{"srcset"}},
+	})
+}
+
+func TestCSS(t *testing.T) {
+	run(t, []test{
+		{name: "plain", input: `<p style="color: red; font-weight: bold">x</p>`, want: []string{`style="color: red; font-weight: bold"`}},
+		{name: "url blocked", input: `<div style="background: url(https://tracker.example/bg.png)">x</div>`, want: []string{"background: none"}, notWant: []string{"tracker"}, blocked: 1},
+		{name: "quoted url blocked", input: `<div style='background-image: url("https://tracker.example/bg.png")'>x</div>`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "uppercase url blocked", input: `<div style="background: URL( 'https://tracker.example/bg.png' )">x</div>`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "each url counts", input: `<div style="background: url(https://a.example/1.png), url(//a.example/2.png)">x</div>`, notWant: []string{"a.example"}, blocked: 2},
+		{
+			name:  "url allowed",
+			input: `<div style="background: url('https://example.com/bg.png')">x</div>`,
+			opts:  remote,
+			want:  []string{`url(&#34;/proxy/image?url=https%3a%2f%2fexample.com%2fbg.png&#34;)`},
+		},
+		{name: "javascript url", input: `<div style="background: url(javascript:alert(1))">x</div>`, opts: remote, notWant: []string{"javascript"}},
+		{name: "data svg url", input: `<div style="background: url(data:image/svg+xml;base64,PHN2Zz4=)">x</div>`, notWant: []string{"data:"}},
+		{name: "data png url", input: `<div style="background: url(data:image/png;base64,iVBORw0KGgo=)">x</div>`, want: []string{"url(data:image/png;base64,"}},
+		{name: "expression", input: `<p style="width: expression(alert(1))">x</p>`, want: []string{"x-removed-expression("}, notWant: []string{" expression("}},
+		{name: "expression with space", input: `<p style="width: EXPRESSION (alert(1))">x</p>`, want: []string{"x-removed-expression ("}, notWant: []string{" expression ("}},
+		{name: "behavior", input: `<p style="behavior: url(evil.htc)">x</p>`, want: []string{`style="x-removed-behavior:`}},
+		{name: "moz-binding", input: `<p style="-moz-binding: url(evil.xml#x)">x</p>`, want: []string{`style="x-removed--moz-binding:`}},
+		{name: "image-set", input: `<p style="background: image-set('https://tracker.example/a.png' 1x)">x</p>`, want: []string{"x-removed-image-set("}},
+		{name: "comment in url", input: `<div style="background: u/**/rl(https://tracker.example/bg.png)">x</div>`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "comment in expression", input: `<p style="width: expr/* x */ession(alert(1))">x</p>`, notWant: []string{" expression("}},
+		{name: "escaped url", input: `<div style="background: u\72 l(https://tracker.example/bg.png)">x</div>`, notWant: []string{"tracker"}, blocked: 1},
+		{name: "escaped colon in url", input: `<div style="background: url(https\3a //tracker.example/bg.png)">x</div>`, notWant: []string{"url("}},
+		{name: "escaped quote in url", input: `<div style='background: url("https://tracker.example/a\".png")'>x</div>`, notWant: []string{"url("}},
+		{name: "unterminated url", input: `<div style="background: url(https://tracker.example/bg.png">x</div>`, notWant: []string{"url("}},
+		{name: "escaped expression", input: `<p style="width: \65 xpression(alert(1))">x</p>`, notWant: []string{" expression("}},
+
+		{
+			name:    "style element",
+			input:   `<style>@import url("https://evil.example/a.css"); @import 'https://evil.example/b.css'; body { background: url(https://tracker.example/bg.png) } p { color: red }</style>`,
+			want:    []string{"p { color: red }", "@x-removed"},
+			notWant: []string{"@import", "tracker"},
+			blocked: 2,
+		},
+		{name: "style element comments", input: `<style>@im/**/port "https://evil.example/a.css"; body { background: u/**/rl(https://tracker.example/bg.png) }</style>`, notWant: []string{"@import", "tracker"}, blocked: 1},
+		{name: "style element escapes", input: `<style>@\69mport "https://evil.example/a.css";</style>`, notWant: []string{"@import"}},
+		{name: "style element can't be closed", input: `<style>p { color: red }</st/**/yle><script>alert(1)</script></style>`, notWant: []string{"<script"}},
+		{name: "style element escaped lt", input: `<style>a::after { content: "\3c/style>" }</style>`, want: []string{`content: "\3c/style>" }</style>`}},
+		{name: "svg style element", input: `<svg><style>@import "https://evil.example/a.css";</style></svg>`, notWant: []string{"@import"}},
+	})
+}
+
+func TestCID(t *testing.T) {
+	run(t, []test{
+		{name: "img", input: `<img src="cid:logo@example.com">`, opts: remote, want: []string{`src="/email/attachments/logo@example.com"`}},
+		{name: "uppercase", input: `<img src="CID:logo@example.com">`, opts: remote, want: []string{`src="/email/attachments/logo@example.com"`}},
+		{name: "percent encoded", input: `<img src="cid:%3Clogo%40example.com%3E">`, opts: remote, want: []string{`src="/email/attachments/logo@example.com"`}},
+		{name: "missing part", input: `<img src="cid:missing@example.com">`, opts: remote, notWant: []string{"src="}},
+		{name: "no rewriter", input: `<img src="cid:logo@example.com">`, opts: Options{AllowRemoteImages: true}, notWant: []string{"src="}},
+		{name: "bad encoding", input: `<img src="cid:%zz">`, opts: remote, notWant: []string{"src="}},
+		{name: "css", input: `<div style="background: url(cid:bg@example.com)">x</div>`, opts: remote, want: []string{`url(&#34;/email/attachments/bg@example.com&#34;)`}},
+		{name: "css missing part", input: `<div style="background: url(cid:missing@example.com)">x</div>`, opts: remote, want: []string{"background: none"}},
+		{name: "not counted as remote", input: `<img src="cid:logo@example.com">`, opts: Options{RewriteCID: cid}, blocked: 0, want: []string{"/email/attachments/"}},
+	})
+}
+
+func TestRewriteCID(t *testing.T) {
+	var got string
+	opts := Options{RewriteCID: func(id string) string {
+		got = id
+		return "/x"
+	}}
+
+	for value, want := range map[string]string{
+		"cid:part1@example.com":         "part1@example.com",
+		" cid:part1@example.com ":       "part1@example.com",
+		"CID:part1@example.com":         "part1@example.com",
+		"cid:%3Cpart1%40example.com%3E": "part1@example.com",
+		"cid:<part1@example.com>":       "part1@example.com",
+		"c\tid:part1@example.com":       "part1@example.com",
+	} {
+		got = ""
+		if rewriteCID(value, opts) != "/x" || got != want {
+			t.Errorf("rewriteCID(%q) looked up %q, want %q", value, got, want)
+		}
+	}
+}
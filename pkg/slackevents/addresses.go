@@ -0,0 +1,386 @@
+package slackevents
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/config"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+	"github.com/cjdenio/temp-email/pkg/notify"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+)
+
+var (
+	errNoMoreExtensions = errors.New("no more extensions")
+	errLifetimeTooShort = errors.New("lifetime too short")
+	errAliasTaken       = errors.New("alias taken")
+)
+
+type lifetimeTooLongError struct {
+	Max time.Duration
+}
+
+func (e *lifetimeTooLongError) Error() string {
+	return fmt.Sprintf("lifetime longer than %s", e.Max)
+}
+
+// How many random IDs to try before giving up on finding a free one
+const maxGenerateAttempts = 10
+
+// Durations offered in the extend/reactivate pickers, on top of the default
+var lifetimeChoices = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	3 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+}
+
+// Makes sure a requested lifetime is within the domain's limits
+func checkLifetime(ttl time.Duration, domain db.Domain) error {
+	_, maxTTL := lifetimeLimits(domain)
+
+	if ttl < time.Minute {
+		return errLifetimeTooShort
+	}
+	if ttl > maxTTL {
+		return &lifetimeTooLongError{Max: maxTTL}
+	}
+	return nil
+}
+
+func addressExists(id string) (bool, error) {
+	var count int64
+	tx := db.DB.Model(&db.Address{}).Where("id = ?", id).Count(&count)
+	return count > 0, tx.Error
+}
+
+// Makes sure a user-chosen alias is valid and nobody has it yet. Aliases
+// stay taken after they expire, since their old emails still point at them.
+func checkAlias(alias string) error {
+	if err := util.ValidateAlias(alias); err != nil {
+		return err
+	}
+
+	exists, err := addressExists(alias)
+	if err != nil {
+		return err
+	} else if exists {
+		return errAliasTaken
+	}
+
+	return nil
+}
+
+// Generates a random ID that isn't in use yet
+func uniqueAddressID() (string, error) {
+	for i := 0; i < maxGenerateAttempts; i++ {
+		id := ids.Address()
+
+		exists, err := addressExists(id)
+		if err != nil {
+			return "", err
+		} else if !exists {
+			return id, nil
+		}
+	}
+
+	return "", errors.New("couldn't generate a unique address")
+}
+
+type addressRequest struct {
+	User   string
+	Domain db.Domain
+
+	// A random ID is generated if there's no alias
+	Alias string
+
+	// Zero means the domain's default lifetime
+	TTL time.Duration
+
+	// The thread emails get posted in
+	Channel   string
+	Timestamp string
+}
+
+// Issues a new address
+func createAddress(req addressRequest) (db.Address, error) {
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl, _ = lifetimeLimits(req.Domain)
+	}
+	if err := checkLifetime(ttl, req.Domain); err != nil {
+		return db.Address{}, err
+	}
+
+	alias := req.Alias
+	id := alias
+	if id == "" {
+		var err error
+		id, err = uniqueAddressID()
+		if err != nil {
+			return db.Address{}, err
+		}
+	} else if err := checkAlias(alias); err != nil {
+		return db.Address{}, err
+	}
+
+	address := db.Address{
+		ID:        id,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+		Domain:    req.Domain.Name,
+		Channel:   req.Channel,
+		Timestamp: req.Timestamp,
+		User:      req.User,
+	}
+
+	if tx := db.DB.Create(&address); tx.Error != nil {
+		// Someone else might have grabbed the same ID in the meantime
+		if exists, err := addressExists(id); err == nil && exists {
+			return db.Address{}, errAliasTaken
+		}
+		return db.Address{}, tx.Error
+	}
+
+	return address, nil
+}
+
+// Issues an address that wasn't asked for with a channel message, starting a
+// thread for it in its domain's channel with intro as the first message
+func createThreadAddress(req addressRequest, intro string) (db.Address, error) {
+	// Check everything up front so we don't start a thread for nothing
+	if req.TTL != 0 {
+		if err := checkLifetime(req.TTL, req.Domain); err != nil {
+			return db.Address{}, err
+		}
+	}
+	if req.Alias != "" {
+		if err := checkAlias(req.Alias); err != nil {
+			return db.Address{}, err
+		}
+	}
+
+	req.Channel = domainChannel(req.Domain)
+
+	// Every address needs a thread to post its emails in
+	_, ts, err := Client.PostMessage(req.Channel, slack.MsgOptionText(intro, false))
+	if err != nil {
+		return db.Address{}, err
+	}
+	req.Timestamp = ts
+
+	address, err := createAddress(req)
+	if err != nil {
+		Client.DeleteMessage(req.Channel, ts)
+		return db.Address{}, err
+	}
+
+	Client.PostMessage(
+		address.Channel,
+		slack.MsgOptionText(issuedText(address, fmt.Sprintf("run `/tempmail delete %s`", address.ID)), false),
+		slack.MsgOptionTS(address.Timestamp),
+	)
+
+	return address, nil
+}
+
+// The message posted at the top of a new address's thread
+func issuedText(address db.Address, howToStop string) string {
+	return fmt.Sprintf(`wahoo! your temporary email address is %s
+it'll keep working until %s.
+
+to stop receiving emails, %s.
+
+i'll post emails in this thread :arrow_down: (or see them all <%s|in your browser>)`, fullAddress(address), util.SlackDate(address.ExpiresAt), howToStop, InboxURL(address))
+}
+
+// Keeps an address alive for d from now, reactivating it if it had expired.
+// Zero means the domain's default lifetime.
+func extendAddress(address *db.Address, d time.Duration) error {
+	domain := addressDomain(*address)
+	if d == 0 {
+		d, _ = lifetimeLimits(domain)
+	}
+
+	if err := checkLifetime(d, domain); err != nil {
+		return err
+	}
+	if config.MaxExtensions > 0 && address.Extensions >= config.MaxExtensions {
+		return errNoMoreExtensions
+	}
+
+	address.ExpiresAt = time.Now().Add(d)
+	address.ExpiredMessageSent = false
+	address.Extensions++
+
+	if tx := db.DB.Save(address); tx.Error != nil {
+		return tx.Error
+	}
+
+	Client.PostMessage(address.Channel, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText(fmt.Sprintf("This address will be available until %s!", util.SlackDate(address.ExpiresAt)), false))
+	Client.RemoveReaction("clock1", slack.ItemRef{
+		Channel:   address.Channel,
+		Timestamp: address.Timestamp,
+	})
+	refreshHome(address.User)
+
+	return nil
+}
+
+// Stops an address from receiving mail right away and lets its owner know why
+func deactivateAddress(address *db.Address, reason string) error {
+	address.ExpiresAt = time.Now()
+	address.ExpiredMessageSent = true
+
+	if tx := db.DB.Save(address); tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := notify.For(*address).Deactivated(*address, reason); err != nil {
+		log.Println(err)
+	}
+	refreshHome(address.User)
+
+	return nil
+}
+
+// Changes where an address's notifications go, letting its thread know if
+// they won't show up there anymore
+func setNotifier(address *db.Address, kind, target string) error {
+	if err := notify.Validate(kind, target); err != nil {
+		return err
+	}
+
+	if kind == notify.Slack {
+		kind, target = "", ""
+	}
+
+	address.Notifier = kind
+	address.NotifierTarget = target
+	if tx := db.DB.Model(address).Updates(map[string]interface{}{"notifier": kind, "notifier_target": target}); tx.Error != nil {
+		log.Println(tx.Error)
+		return errors.New("couldn't be saved, something went wrong")
+	}
+
+	text := "emails to this address will be posted in this thread again"
+	if kind != "" {
+		text = fmt.Sprintf("emails to this address will be sent to %s instead of this thread", kind)
+	}
+	Client.PostMessage(address.Channel, slack.MsgOptionText(text, false), slack.MsgOptionTS(address.Timestamp))
+
+	return nil
+}
+
+func viewURL(emailID string) string {
+	return fmt.Sprintf("%s/%s", os.Getenv("APP_DOMAIN"), emailID)
+}
+
+func fullAddress(address db.Address) string {
+	return fmt.Sprintf("%s@%s", address.ID, address.Domain)
+}
+
+// Describes when an address expires, e.g. "expires in 3h 20m"
+func formatExpiry(expiresAt time.Time) string {
+	remaining := time.Until(expiresAt)
+	if remaining <= 0 {
+		return "expired"
+	}
+
+	remaining = remaining.Round(time.Minute)
+	days := int(remaining / (24 * time.Hour))
+	hours := int(remaining/time.Hour) % 24
+	minutes := int(remaining/time.Minute) % 60
+
+	if days > 0 {
+		return fmt.Sprintf("expires in %dd %dh", days, hours)
+	} else if hours > 0 {
+		return fmt.Sprintf("expires in %dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("expires in %dm", minutes)
+}
+
+// Turns a createAddress or extendAddress error into something to tell the user
+func addressErrorText(err error) string {
+	var invalid *util.InvalidAliasError
+	if errors.As(err, &invalid) {
+		return invalid.Reason
+	}
+
+	var tooLong *lifetimeTooLongError
+	if errors.As(err, &tooLong) {
+		return fmt.Sprintf("sorry, the longest i can do is %s", util.FormatDuration(tooLong.Max))
+	}
+
+	switch err {
+	case errAliasTaken:
+		return "sorry, that name is already taken. try another one!"
+	case errNoMoreExtensions:
+		return fmt.Sprintf("this address has already been extended %d times, which is as many as i allow :pensive:", config.MaxExtensions)
+	case errLifetimeTooShort:
+		return "that's not a very long time :thinking_face:"
+	case errUnknownDomain:
+		return fmt.Sprintf("sorry, i don't handle mail for that domain. try one of %s", strings.Join(domainNames(), ", "))
+	default:
+		return "aaaaaaaaaaaaaaaaaaaa something went wrong"
+	}
+}
+
+// A dropdown of lifetimes to extend an address by. Option values are
+// "<address>|<duration>".
+func lifetimeSelect(actionID string, address db.Address) *slack.SelectBlockElement {
+	var options []*slack.OptionBlockObject
+
+	defaultTTL, maxTTL := lifetimeLimits(addressDomain(address))
+
+	for _, d := range append([]time.Duration{defaultTTL}, lifetimeChoices...) {
+		if d > maxTTL {
+			continue
+		}
+
+		value := fmt.Sprintf("%s|%s", address.ID, d)
+		duplicate := false
+		for _, o := range options {
+			if o.Value == value {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		options = append(options, slack.NewOptionBlockObject(value, slack.NewTextBlockObject(slack.PlainTextType, util.FormatDuration(d), false, false), nil))
+	}
+
+	return slack.NewOptionsSelectBlockElement(slack.OptTypeStatic, slack.NewTextBlockObject(slack.PlainTextType, "Pick a duration", false, false), actionID, options...)
+}
+
+// Parses a value from lifetimeSelect
+func parseLifetimeOption(value string) (string, time.Duration, error) {
+	split := strings.SplitN(value, "|", 2)
+	if len(split) != 2 {
+		return "", 0, errors.New("invalid option")
+	}
+
+	d, err := time.ParseDuration(split[1])
+	return split[0], d, err
+}
+
+// The blocks posted in a thread when its address expires
+func ExpiredBlocks(address db.Address) []slack.Block {
+	defaultTTL, _ := lifetimeLimits(addressDomain(address))
+
+	return []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf(":x: :clock1: this address expired %s, so it will no longer receive mail.", util.SlackDate(address.ExpiresAt)), false, false), nil, nil),
+		slack.NewActionBlock("reactivate",
+			slack.NewButtonBlockElement("reactivate", address.ID, slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("Get another %s", util.FormatDuration(defaultTTL)), false, false)),
+			lifetimeSelect("reactivate_for", address),
+		),
+	}
+}
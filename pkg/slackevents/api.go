@@ -0,0 +1,368 @@
+package slackevents
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/notify"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// How many messages GET /addresses/:id/messages returns at most
+const apiMessagesLimit = 100
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiAddress struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	Domain    string    `json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Active    bool      `json:"active"`
+	InboxURL  string    `json:"inbox_url"`
+	Notifier  string    `json:"notifier"`
+}
+
+type apiMessageSummary struct {
+	ID         string    `json:"id"`
+	AddressID  string    `json:"address_id"`
+	Tag        string    `json:"tag,omitempty"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	ReceivedAt time.Time `json:"received_at"`
+	URL        string    `json:"url"`
+}
+
+type apiMessage struct {
+	apiMessageSummary
+
+	To      []string            `json:"to"`
+	Cc      []string            `json:"cc"`
+	ReplyTo []string            `json:"reply_to"`
+	Date    *time.Time          `json:"date"`
+	Text    string              `json:"text"`
+	HTML    string              `json:"html"`
+	Headers map[string][]string `json:"headers"`
+
+	Attachments []apiAttachment `json:"attachments"`
+
+	Auth struct {
+		Verdict string `json:"verdict"`
+		Results string `json:"results"`
+	} `json:"auth"`
+
+	RawURL string `json:"raw_url"`
+}
+
+type apiAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+func apiBaseURL() string {
+	return os.Getenv("APP_DOMAIN") + "/api/v1"
+}
+
+func toAPIAddress(address db.Address) apiAddress {
+	return apiAddress{
+		ID:        address.ID,
+		Address:   fullAddress(address),
+		Domain:    address.Domain,
+		CreatedAt: address.CreatedAt,
+		ExpiresAt: address.ExpiresAt,
+		Active:    address.ExpiresAt.After(time.Now()),
+		InboxURL:  InboxURL(address),
+		Notifier:  notifierName(address),
+	}
+}
+
+func notifierName(address db.Address) string {
+	if address.Notifier == "" {
+		return notify.Slack
+	}
+	return address.Notifier
+}
+
+func toAPIMessageSummary(email db.Email) apiMessageSummary {
+	return apiMessageSummary{
+		ID:         email.ID,
+		AddressID:  email.AddressID,
+		Tag:        email.Tag,
+		From:       email.From,
+		Subject:    email.Subject,
+		ReceivedAt: email.CreatedAt,
+		URL:        viewURL(email.ID),
+	}
+}
+
+func apiFail(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, apiError{Error: message})
+}
+
+// Checks the request's bearer token and remembers who it belongs to
+func apiAuth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		apiFail(c, http.StatusUnauthorized, "missing bearer token")
+		return
+	}
+
+	token, ok := authenticateToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	if !ok {
+		apiFail(c, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	c.Set("user", token.User)
+	c.Next()
+}
+
+// Looks up the :id address, making sure it belongs to the caller
+func apiFindAddress(c *gin.Context) (db.Address, bool) {
+	var address db.Address
+	tx := db.DB.Where("id = ? AND \"user\" = ?", strings.ToLower(c.Param("id")), c.GetString("user")).First(&address)
+	if tx.Error == gorm.ErrRecordNotFound {
+		apiFail(c, http.StatusNotFound, "address not found")
+		return address, false
+	} else if tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return address, false
+	}
+
+	return address, true
+}
+
+func registerAPIRoutes(r *gin.Engine) {
+	api := r.Group("/api/v1", apiAuth)
+
+	api.GET("/addresses", apiListAddresses)
+	api.POST("/addresses", apiCreateAddress)
+	api.GET("/addresses/:id", apiGetAddress)
+	api.GET("/addresses/:id/messages", apiListMessages)
+	api.GET("/messages/:id", apiGetMessage)
+
+	registerWebhookRoutes(api)
+}
+
+func apiListAddresses(c *gin.Context) {
+	var addresses []db.Address
+	if tx := db.DB.Where("\"user\" = ?", c.GetString("user")).Order("created_at DESC").Find(&addresses); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	result := []apiAddress{}
+	for _, address := range addresses {
+		result = append(result, toAPIAddress(address))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func apiCreateAddress(c *gin.Context) {
+	var body struct {
+		Alias  string `json:"alias"`
+		Domain string `json:"domain"`
+
+		// Anything /tempmail understands, e.g. "3 days" or "12h"
+		TTL string `json:"ttl"`
+
+		// Where to send notifications instead of Slack, e.g. "http" with a
+		// URL as the target
+		Notifier       string `json:"notifier"`
+		NotifierTarget string `json:"notifier_target"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			apiFail(c, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = util.ParseDuration(body.TTL); err != nil {
+			apiFail(c, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", body.TTL))
+			return
+		}
+	}
+
+	if body.Notifier != "" {
+		if err := notify.Validate(body.Notifier, body.NotifierTarget); err != nil {
+			apiFail(c, http.StatusBadRequest, fmt.Sprintf("notifier %s %s", body.Notifier, err))
+			return
+		}
+	}
+
+	domainName := body.Domain
+	if domainName == "" {
+		domainName = defaultDomainName()
+	}
+	domain, err := findDomain(domainName)
+	if err != nil {
+		apiFail(c, apiErrorStatus(err), addressErrorText(err))
+		return
+	}
+
+	user := c.GetString("user")
+	address, err := createThreadAddress(addressRequest{
+		User:   user,
+		Domain: domain,
+		Alias:  strings.ToLower(body.Alias),
+		TTL:    ttl,
+	}, fmt.Sprintf("<@%s> asked for a temporary email address through the API", user))
+	if err != nil {
+		log.Println(err)
+		apiFail(c, apiErrorStatus(err), addressErrorText(err))
+		return
+	}
+
+	if body.Notifier != "" && body.Notifier != notify.Slack {
+		if err := setNotifier(&address, body.Notifier, body.NotifierTarget); err != nil {
+			log.Println(err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, toAPIAddress(address))
+}
+
+// The HTTP status for an error from createThreadAddress
+func apiErrorStatus(err error) int {
+	var invalid *util.InvalidAliasError
+	var tooLong *lifetimeTooLongError
+
+	switch {
+	case err == errAliasTaken:
+		return http.StatusConflict
+	case err == errLifetimeTooShort, err == errUnknownDomain, errors.As(err, &invalid), errors.As(err, &tooLong):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func apiGetAddress(c *gin.Context) {
+	address, ok := apiFindAddress(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, toAPIAddress(address))
+}
+
+// Lists an address's messages, newest first. Pollers can pass ?since= (an
+// RFC 3339 time) to only get new ones, and ?tag= to filter by subaddress.
+func apiListMessages(c *gin.Context) {
+	address, ok := apiFindAddress(c)
+	if !ok {
+		return
+	}
+
+	query := db.DB.Select("id", "created_at", "address_id", "from", "subject", "tag").Where("address_id = ?", address.ID)
+	if tag := c.Query("tag"); tag != "" {
+		query = query.Where("tag = ?", strings.ToLower(tag))
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			apiFail(c, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		query = query.Where("created_at > ?", t)
+	}
+
+	var emails []db.Email
+	if tx := query.Order("created_at DESC").Limit(apiMessagesLimit).Find(&emails); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	result := []apiMessageSummary{}
+	for _, email := range emails {
+		result = append(result, toAPIMessageSummary(email))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func apiGetMessage(c *gin.Context) {
+	var email db.Email
+	tx := db.DB.Joins("Address").Where("emails.id = ? AND \"Address\".\"user\" = ?", c.Param("id"), c.GetString("user")).First(&email)
+	if tx.Error == gorm.ErrRecordNotFound {
+		apiFail(c, http.StatusNotFound, "message not found")
+		return
+	} else if tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	parsed, err := parsemail.Parse(strings.NewReader(email.Content))
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, "couldn't parse message")
+		return
+	}
+
+	var attachments []db.Attachment
+	if tx := db.DB.Where("email_id = ?", email.ID).Order("filename").Find(&attachments); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	result := apiMessage{
+		apiMessageSummary: toAPIMessageSummary(email),
+		To:                []string{},
+		Cc:                []string{},
+		ReplyTo:           []string{},
+		Text:              parsed.TextBody,
+		HTML:              parsed.HTMLBody,
+		Headers:           parsed.Header,
+		Attachments:       []apiAttachment{},
+		RawURL:            viewURL(email.ID) + "/raw",
+	}
+	for _, a := range parsed.To {
+		result.To = append(result.To, a.String())
+	}
+	for _, a := range parsed.Cc {
+		result.Cc = append(result.Cc, a.String())
+	}
+	for _, a := range parsed.ReplyTo {
+		result.ReplyTo = append(result.ReplyTo, a.String())
+	}
+	if !parsed.Date.IsZero() {
+		result.Date = &parsed.Date
+	}
+	for _, a := range attachments {
+		result.Attachments = append(result.Attachments, apiAttachment{
+			ID:          a.ID,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			URL:         attachmentURL(a),
+		})
+	}
+	result.Auth.Verdict = email.AuthVerdict
+	result.Auth.Results = email.AuthResults
+
+	c.JSON(http.StatusOK, result)
+}
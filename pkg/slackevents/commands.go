@@ -0,0 +1,333 @@
+package slackevents
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/mailbox"
+	"github.com/cjdenio/temp-email/pkg/notify"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+	"gorm.io/gorm"
+)
+
+const commandHelp = "*usage:*\n" +
+	"• `/tempmail new [name][@domain] [for <duration>]`: get a new temporary address, e.g. `/tempmail new`, `/tempmail new cool-name for 3 days` or `/tempmail new @other.domain`\n" +
+	"• `/tempmail list`: list your addresses\n" +
+	"• `/tempmail extend <address> [duration]`: keep an address around for longer\n" +
+	"• `/tempmail delete <address>`: stop an address from receiving mail\n" +
+	"• `/tempmail messages <address>[+tag]`: list recent emails, optionally only those sent to a tag\n" +
+	"• `/tempmail notify <address> <slack|discord <webhook url>|matrix <room id>|http <url>>`: choose where an address's emails are sent\n" +
+	"• `/tempmail password <address>`: get a password for reading an address's emails over IMAP or POP3\n" +
+	"• `/tempmail domains`: list the domains you can get addresses on\n" +
+	"• `/tempmail token <new [name]|list|revoke <id>>`: manage tokens for the JSON API\n" +
+	"• `/tempmail webhook <add <url> [address]|list|remove <id>|replay <id>>`: get emails POSTed to your own endpoints\n" +
+	"• `/tempmail help`: show this message\n\n" +
+	"to reply to an email, start a message in its address's thread with `reply:`, or use the _Reply to email_ shortcut on it"
+
+func ephemeral(text string) slack.Msg {
+	return slack.Msg{
+		ResponseType: slack.ResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// Handles /tempmail, returning the ephemeral response to show the user
+func handleCommand(cmd slack.SlashCommand) slack.Msg {
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 {
+		return ephemeral(commandHelp)
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "new":
+		alias, domain, ttl, err := parseNewArgs(args[1:])
+		if err != nil {
+			return ephemeral(err.Error())
+		}
+
+		return commandNew(cmd, alias, domain, ttl)
+	case "list":
+		return commandList(cmd)
+	case "domains":
+		return commandDomains(cmd)
+	case "token":
+		return commandToken(cmd, args[1:])
+	case "webhook":
+		return commandWebhook(cmd, args[1:])
+	case "extend", "delete", "messages", "notify", "password":
+		if len(args) < 2 {
+			return ephemeral(fmt.Sprintf("which address? try `/tempmail %s <address>`", strings.ToLower(args[0])))
+		}
+
+		// Accept "abc123", "abc123@domain" and "abc123+tag@domain"
+		split := strings.SplitN(strings.ToLower(unlinkText(args[1])), "@", 2)
+		local := strings.SplitN(split[0], "+", 2)
+		id := local[0]
+
+		query := db.DB.Where("id = ? AND \"user\" = ?", id, cmd.UserID)
+		if len(split) == 2 {
+			query = query.Where("domain = ?", split[1])
+		}
+
+		var address db.Address
+		tx := query.First(&address)
+		if tx.Error == gorm.ErrRecordNotFound {
+			return ephemeral(fmt.Sprintf("you don't have an address called `%s` :thinking_face:", id))
+		} else if tx.Error != nil {
+			log.Println(tx.Error)
+			return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		}
+
+		if strings.ToLower(args[0]) == "extend" {
+			d, err := parseCommandLifetime(args[2:])
+			if err != nil {
+				return ephemeral(err.Error())
+			}
+
+			return commandExtend(address, d)
+		} else if strings.ToLower(args[0]) == "messages" {
+			tag := ""
+			if len(local) == 2 {
+				tag = local[1]
+			}
+
+			return commandMessages(address, tag)
+		} else if strings.ToLower(args[0]) == "notify" {
+			return commandNotify(address, args[2:])
+		} else if strings.ToLower(args[0]) == "password" {
+			return commandPassword(address)
+		}
+		return commandDelete(address)
+	case "help":
+		return ephemeral(commandHelp)
+	default:
+		return ephemeral(fmt.Sprintf("unfortunately i don't know how to _\"%s\"_.\n\n%s", args[0], commandHelp))
+	}
+}
+
+// Reads an optional duration like "3 days" off the end of a command. Zero
+// means the domain's default.
+func parseCommandLifetime(args []string) (time.Duration, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	d, err := util.ParseDuration(strings.Join(args, " "))
+	if err != nil {
+		return 0, fmt.Errorf("i'm not sure how long _\"%s\"_ is. try something like `3 days` or `12 hours`", strings.Join(args, " "))
+	}
+
+	return d, nil
+}
+
+// Parses "[name][@domain] [for <duration>]". A bare duration like "3 days"
+// works too.
+func parseNewArgs(args []string) (string, string, time.Duration, error) {
+	if len(args) == 0 {
+		return "", "", 0, nil
+	}
+
+	if _, err := util.ParseDuration(strings.Join(args, " ")); err == nil {
+		ttl, err := parseCommandLifetime(args)
+		return "", "", ttl, err
+	}
+
+	alias, domain := "", ""
+	if strings.ToLower(args[0]) != "for" {
+		split := strings.SplitN(strings.ToLower(unlinkText(args[0])), "@", 2)
+		alias = split[0]
+		if len(split) == 2 {
+			domain = split[1]
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 && strings.ToLower(args[0]) == "for" {
+		args = args[1:]
+	}
+
+	ttl, err := parseCommandLifetime(args)
+	return alias, domain, ttl, err
+}
+
+// Picks the domain for a new address: the one asked for, or else whichever
+// fits the channel the request came from
+func chooseDomain(name, channel string) (db.Domain, error) {
+	if name != "" {
+		return findDomain(name)
+	}
+
+	if domain, ok := domainForChannel(channel); ok {
+		return domain, nil
+	}
+	return findDomain(defaultDomainName())
+}
+
+func commandNew(cmd slack.SlashCommand, alias, domainName string, ttl time.Duration) slack.Msg {
+	domain, err := chooseDomain(domainName, cmd.ChannelID)
+	if err != nil {
+		log.Println(err)
+		return ephemeral(addressErrorText(err))
+	}
+
+	address, err := createThreadAddress(addressRequest{
+		User:   cmd.UserID,
+		Domain: domain,
+		Alias:  alias,
+		TTL:    ttl,
+	}, fmt.Sprintf("<@%s> asked for a temporary email address", cmd.UserID))
+	if err != nil {
+		log.Println(err)
+		return ephemeral(addressErrorText(err))
+	}
+
+	text := fmt.Sprintf("wahoo! your temporary email address is %s, and it'll keep working until %s", fullAddress(address), util.SlackDate(address.ExpiresAt))
+
+	permalink, err := Client.GetPermalink(&slack.PermalinkParameters{
+		Channel: address.Channel,
+		Ts:      address.Timestamp,
+	})
+	if err == nil {
+		text += fmt.Sprintf("\n\ni'll post emails in <%s|this thread>", permalink)
+	}
+
+	return ephemeral(text)
+}
+
+func commandList(cmd slack.SlashCommand) slack.Msg {
+	// Recently expired addresses can still be extended, so show those too
+	var addresses []db.Address
+	tx := db.DB.Where("\"user\" = ? AND expires_at > ?", cmd.UserID, time.Now().Add(-7*24*time.Hour)).Order("created_at DESC").Find(&addresses)
+	if tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	if len(addresses) == 0 {
+		return ephemeral("you don't have any addresses right now. try `/tempmail new`!")
+	}
+
+	lines := []string{"*your addresses:*"}
+	for _, address := range addresses {
+		lines = append(lines, fmt.Sprintf("• `%s`: %s", fullAddress(address), formatExpiry(address.ExpiresAt)))
+	}
+
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func commandDomains(cmd slack.SlashCommand) slack.Msg {
+	var domains []db.Domain
+	if tx := db.DB.Order("name").Find(&domains); tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	lines := []string{"*domains i handle mail for:*"}
+	for _, domain := range domains {
+		defaultTTL, maxTTL := lifetimeLimits(domain)
+
+		line := fmt.Sprintf("• `%s`: addresses last %s by default, up to %s, and post in <#%s>", domain.Name, util.FormatDuration(defaultTTL), util.FormatDuration(maxTTL), domainChannel(domain))
+		if domain.Name == defaultDomainName() {
+			line += " _(default)_"
+		}
+		lines = append(lines, line)
+	}
+
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func commandExtend(address db.Address, d time.Duration) slack.Msg {
+	if err := extendAddress(&address, d); err != nil {
+		log.Println(err)
+		return ephemeral(addressErrorText(err))
+	}
+
+	return ephemeral(fmt.Sprintf("`%s` will be available until %s!", fullAddress(address), util.SlackDate(address.ExpiresAt)))
+}
+
+func commandDelete(address db.Address) slack.Msg {
+	if !address.ExpiresAt.After(time.Now()) {
+		return ephemeral(fmt.Sprintf("`%s` has already expired", fullAddress(address)))
+	}
+
+	if err := deactivateAddress(&address, "since you asked"); err != nil {
+		log.Println(err)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	return ephemeral(fmt.Sprintf("`%s` has been deactivated", fullAddress(address)))
+}
+
+// How many emails /tempmail messages shows
+const commandMessagesLimit = 10
+
+func commandMessages(address db.Address, tag string) slack.Msg {
+	query := db.DB.Select("id", "created_at", "from", "subject", "tag").Where("address_id = ?", address.ID)
+	if tag != "" {
+		query = query.Where("tag = ?", tag)
+	}
+
+	var emails []db.Email
+	if tx := query.Order("created_at DESC").Limit(commandMessagesLimit).Find(&emails); tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	name := fullAddress(address)
+	if tag != "" {
+		name = fmt.Sprintf("%s+%s@%s", address.ID, tag, address.Domain)
+	}
+
+	if len(emails) == 0 {
+		return ephemeral(fmt.Sprintf("`%s` hasn't received any emails yet", name))
+	}
+
+	lines := []string{fmt.Sprintf("*recent emails to `%s`:*", name)}
+	for _, email := range emails {
+		subject := email.Subject
+		if subject == "" {
+			subject = "no subject"
+		}
+
+		line := fmt.Sprintf("• <%s|%s> from %s, %s", viewURL(email.ID), util.SanitizeInput(subject), util.SanitizeInput(email.From), util.SlackDate(email.CreatedAt))
+		if email.Tag != "" && tag == "" {
+			line += fmt.Sprintf(" `+%s`", util.SanitizeInput(strings.ReplaceAll(email.Tag, "`", "")))
+		}
+		lines = append(lines, line)
+	}
+
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func commandNotify(address db.Address, args []string) slack.Msg {
+	if len(args) == 0 {
+		return ephemeral(fmt.Sprintf("where to? try one of %s, e.g. `/tempmail notify %s discord <webhook url>`", strings.Join(notify.Kinds(), ", "), address.ID))
+	}
+
+	kind := strings.ToLower(args[0])
+	target := ""
+	if len(args) > 1 {
+		target = unlinkText(args[1])
+	}
+
+	if err := setNotifier(&address, kind, target); err == notify.ErrUnknownKind {
+		return ephemeral(fmt.Sprintf("i don't know how to notify _\"%s\"_. try one of %s", kind, strings.Join(notify.Kinds(), ", ")))
+	} else if err != nil {
+		return ephemeral(fmt.Sprintf("%s %s", kind, err))
+	}
+
+	return ephemeral(fmt.Sprintf("emails to `%s` will now be sent to %s", fullAddress(address), kind))
+}
+
+func commandPassword(address db.Address) slack.Msg {
+	password, err := mailbox.NewPassword(&address)
+	if err != nil {
+		log.Println(err)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	return ephemeral(fmt.Sprintf("here's a password for reading `%s` in your mail client:\n\n• username: `%s`\n• password: `%s`\n\nkeep it secret! i won't show it again, and running this command again replaces it.", fullAddress(address), fullAddress(address), password))
+}
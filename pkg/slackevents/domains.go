@@ -0,0 +1,102 @@
+package slackevents
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/config"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"gorm.io/gorm"
+)
+
+var errUnknownDomain = errors.New("unknown domain")
+
+// Matches Slack's link formatting, e.g. "<mailto:a@b.com|a@b.com>"
+var slackLinkPattern = regexp.MustCompile(`<(?:[^|>]*\|)?([^>]*)>`)
+
+// Undoes Slack's auto-linking so typed addresses and domains can be parsed
+func unlinkText(text string) string {
+	return slackLinkPattern.ReplaceAllString(text, "$1")
+}
+
+// The domain new addresses get when nobody asks for a particular one
+func defaultDomainName() string {
+	return strings.ToLower(os.Getenv("DOMAIN"))
+}
+
+func findDomain(name string) (db.Domain, error) {
+	var domain db.Domain
+	tx := db.DB.Where("name = ?", strings.ToLower(name)).First(&domain)
+	if tx.Error == gorm.ErrRecordNotFound {
+		return domain, errUnknownDomain
+	}
+	return domain, tx.Error
+}
+
+// Looks up an address's domain, falling back to global settings if it's
+// since been removed
+func addressDomain(address db.Address) db.Domain {
+	domain, err := findDomain(address.Domain)
+	if err != nil {
+		return db.Domain{Name: address.Domain}
+	}
+	return domain
+}
+
+func domainChannel(domain db.Domain) string {
+	if domain.SlackChannel != "" {
+		return domain.SlackChannel
+	}
+	return os.Getenv("SLACK_CHANNEL")
+}
+
+// Picks the domain for addresses requested in a channel: the default domain
+// if it posts there, otherwise whichever domain is set up for the channel
+func domainForChannel(channel string) (db.Domain, bool) {
+	if domain, err := findDomain(defaultDomainName()); err == nil && domainChannel(domain) == channel {
+		return domain, true
+	}
+
+	var domain db.Domain
+	tx := db.DB.Where("slack_channel = ?", channel).Order("name").First(&domain)
+	if tx.Error != nil {
+		return domain, false
+	}
+	return domain, true
+}
+
+// Whether "gib email" works in a channel
+func isAddressChannel(channel string) bool {
+	if channel == os.Getenv("SLACK_CHANNEL") {
+		return true
+	}
+
+	_, ok := domainForChannel(channel)
+	return ok
+}
+
+func domainNames() []string {
+	var names []string
+	db.DB.Model(&db.Domain{}).Order("name").Pluck("name", &names)
+	return names
+}
+
+// The default and maximum lifetimes for addresses on a domain
+func lifetimeLimits(domain db.Domain) (time.Duration, time.Duration) {
+	defaultTTL, maxTTL := config.DefaultTTL, config.MaxTTL
+
+	if domain.DefaultTTL > 0 {
+		defaultTTL = domain.DefaultTTL
+	}
+	if domain.MaxTTL > 0 {
+		maxTTL = domain.MaxTTL
+	}
+	if defaultTTL > maxTTL {
+		defaultTTL = maxTTL
+	}
+
+	return defaultTTL, maxTTL
+}
@@ -0,0 +1,180 @@
+package slackevents
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+var (
+	// Matches e.g. "gib email called cool-name" or "gib email called cool-name@other.domain"
+	aliasPattern = regexp.MustCompile(`gib email (?:called|named) ([^\s@]+?)(?:@(\S+?))?[.!?,]*(?:\s|$)`)
+
+	// Matches e.g. "gib email at other.domain"
+	domainPattern = regexp.MustCompile(`gib email(?: (?:called|named) \S+)? (?:at|on) @?(\S+?)[.!?,]*(?:\s|$)`)
+
+	// Matches e.g. "gib email for 3 days" or "gib email called cool-name for 3 days"
+	lifetimePattern = regexp.MustCompile(`gib email(?: (?:called|named) \S+)?(?: (?:at|on) \S+)? for (.+?)(?: (?:at|on) \S+)?[.!?]*$`)
+)
+
+// Handles an Events API callback, whether it arrived over HTTP or Socket Mode
+func handleEvent(eventsAPIEvent slackevents.EventsAPIEvent) {
+	innerEvent := eventsAPIEvent.InnerEvent
+	switch ev := innerEvent.Data.(type) {
+	case *slackevents.MessageEvent:
+		// topLevelMessage hits the database, so it goes after the cheap checks
+		// that rule out almost every message
+		if ev.SubType == "" && strings.Contains(strings.ToLower(ev.Text), "gib email") && topLevelMessage(ev) {
+			text := strings.ToLower(unlinkText(ev.Text))
+
+			var ttl time.Duration
+			if match := lifetimePattern.FindStringSubmatch(text); match != nil {
+				parsed, err := util.ParseDuration(match[1])
+				if err != nil {
+					Client.PostMessage(ev.Channel, slack.MsgOptionText(fmt.Sprintf("i'm not sure how long _\"%s\"_ is. try something like _\"gib email for 3 days\"_", match[1]), false), slack.MsgOptionTS(ev.TimeStamp))
+					return
+				}
+				ttl = parsed
+			}
+
+			alias, domainName := "", ""
+			if match := aliasPattern.FindStringSubmatch(text); match != nil {
+				alias, domainName = match[1], match[2]
+			}
+			if match := domainPattern.FindStringSubmatch(text); match != nil {
+				domainName = match[1]
+			}
+
+			domain, err := chooseDomain(domainName, ev.Channel)
+			if err != nil {
+				Client.PostMessage(ev.Channel, slack.MsgOptionText(addressErrorText(err), false), slack.MsgOptionTS(ev.TimeStamp))
+				return
+			}
+
+			address, err := createAddress(addressRequest{
+				User:      ev.User,
+				Domain:    domain,
+				Alias:     alias,
+				TTL:       ttl,
+				Channel:   ev.Channel,
+				Timestamp: ev.TimeStamp,
+			})
+			if err != nil {
+				fmt.Println(err)
+				Client.PostMessage(ev.Channel, slack.MsgOptionText(addressErrorText(err), false), slack.MsgOptionTS(ev.TimeStamp))
+				return
+			}
+
+			err = Client.AddReaction("thumb", slack.ItemRef{
+				Channel:   ev.Channel,
+				Timestamp: ev.TimeStamp,
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			Client.PostMessage(
+				ev.Channel,
+				slack.MsgOptionText(issuedText(address, "delete your 'gib email' message"), false),
+				slack.MsgOptionTS(ev.TimeStamp),
+			)
+		} else if ev.SubType == "" && strings.HasPrefix(strings.ToLower(ev.Text), "gib ") && topLevelMessage(ev) {
+			Client.PostMessage(ev.Channel, slack.MsgOptionText(fmt.Sprintf("unfortunately i am unable to _\"gib %s\"_. maybe try _\"gib email\"_?", strings.TrimPrefix(strings.ToLower(ev.Text), "gib ")), false), slack.MsgOptionTS(ev.TimeStamp))
+		} else if isReplyMessage(ev) {
+			// Sending can take a while, and Slack retries events that aren't
+			// acknowledged quickly
+			go replyFromThread(ev)
+		} else if (ev.SubType == "message_deleted" || (ev.SubType == "message_changed" && ev.Message.SubType == "tombstone")) && topLevelMessage(ev) {
+			var address db.Address
+			tx := db.DB.Where("channel = ? AND timestamp = ? AND expires_at > NOW()", ev.Channel, ev.PreviousMessage.TimeStamp).First(&address)
+
+			if tx.Error == nil {
+				deactivateAddress(&address, "since you deleted your message")
+			}
+		}
+	case *slackevents.AppHomeOpenedEvent:
+		if ev.Tab == "home" {
+			refreshHome(ev.User)
+		}
+	}
+}
+
+// Handles a block action, shortcut or modal submission, whether it arrived
+// over HTTP or Socket Mode
+func handleInteraction(payload slack.InteractionCallback) {
+	switch payload.Type {
+	case slack.InteractionTypeMessageAction:
+		if payload.CallbackID == replyCallbackID {
+			openReplyModal(payload)
+		}
+		return
+	case slack.InteractionTypeViewSubmission:
+		if payload.View.CallbackID == replyCallbackID {
+			go submitReplyModal(payload)
+		}
+		return
+	}
+
+	if len(payload.ActionCallback.BlockActions) == 0 {
+		return
+	}
+
+	action := payload.ActionCallback.BlockActions[0]
+
+	switch action.ActionID {
+	case "reactivate", "reactivate_for":
+		id, d := action.Value, time.Duration(0)
+		if action.ActionID == "reactivate_for" {
+			var err error
+			id, d, err = parseLifetimeOption(action.SelectedOption.Value)
+			if err != nil {
+				return
+			}
+		}
+
+		var address db.Address
+		tx := db.DB.Where("id = ? AND expires_at < NOW()", id).First(&address)
+		if tx.Error != nil {
+			return
+		}
+
+		if payload.User.ID != address.User {
+			Client.PostEphemeral(address.Channel, payload.User.ID, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText("whatcha tryin' to pull here :face_with_raised_eyebrow:", false))
+			return
+		}
+
+		if err := extendAddress(&address, d); err != nil {
+			Client.PostEphemeral(address.Channel, payload.User.ID, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText(addressErrorText(err), false))
+		}
+	case "home_extend", "home_extend_for", "home_deactivate":
+		id, d := action.Value, time.Duration(0)
+		if action.ActionID == "home_extend_for" {
+			var err error
+			id, d, err = parseLifetimeOption(action.SelectedOption.Value)
+			if err != nil {
+				return
+			}
+		}
+
+		// The Home tab only ever shows your own addresses
+		var address db.Address
+		tx := db.DB.Where("id = ? AND \"user\" = ?", id, payload.User.ID).First(&address)
+		if tx.Error != nil {
+			return
+		}
+
+		if action.ActionID == "home_deactivate" {
+			if address.ExpiresAt.After(time.Now()) {
+				deactivateAddress(&address, "since you deactivated it from the Home tab")
+			}
+		} else if err := extendAddress(&address, d); err != nil {
+			Client.PostEphemeral(address.Channel, payload.User.ID, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText(addressErrorText(err), false))
+		}
+	}
+}
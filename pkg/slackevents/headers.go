@@ -0,0 +1,139 @@
+package slackevents
+
+import (
+	"html/template"
+	"log"
+	"mime"
+	"strings"
+
+	"github.com/cjdenio/temp-email/pkg/mailauth"
+	"github.com/gin-gonic/gin"
+)
+
+var headersTemplate = template.Must(template.New("headers").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Headers: {{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 1100px; margin: 0 auto; padding: 16px; }
+table { width: 100%; border-collapse: collapse; margin-bottom: 24px; }
+th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #ccc; vertical-align: top; }
+td { font-family: monospace; word-break: break-all; }
+th { white-space: nowrap; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</h1>
+<p><a href="{{.ViewURL}}">View email</a> · <a href="{{.RawURL}}">Download .eml</a></p>
+
+<h2>Authentication</h2>
+<table>
+<tr><th>Our verdict</th><td>{{.Banner}}</td></tr>
+{{if .AuthResults}}<tr><th>Our results</th><td>{{.AuthResults}}</td></tr>{{end}}
+{{if .TLS}}<tr><th>Delivered over</th><td>{{.TLS}}</td></tr>{{else}}<tr><th>Delivered over</th><td>plaintext</td></tr>{{end}}
+</table>
+
+{{if .ClaimedAuth}}
+<h3>Claimed by sender (unverified)</h3>
+<p class="muted">These headers came with the email. Anyone can write them, so only the results above are ours.</p>
+<table>
+{{range .ClaimedAuth}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}
+</table>
+{{end}}
+
+<h2>Received chain</h2>
+{{if .Received}}
+<p class="muted">Oldest hop first</p>
+<table>
+{{range $i, $hop := .Received}}<tr><th>{{$i}}</th><td>{{$hop}}</td></tr>{{end}}
+</table>
+{{else}}
+<p class="muted">No Received headers.</p>
+{{end}}
+
+<h2>All headers</h2>
+<table>
+{{range .Headers}}<tr><th>{{.Name}}</th><td>{{.Value}}{{if .Decoded}}<br><span class="muted">{{.Decoded}}</span>{{end}}</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+type displayHeader struct {
+	mailauth.HeaderField
+
+	// The value with any RFC 2047 encoded words decoded, if that changes it
+	Decoded string
+}
+
+// Shows an email's headers, pulling out the ones that say where it came from
+func handleHeaders(c *gin.Context) {
+	rawEmail, email, ok := findEmail(c)
+	if !ok {
+		return
+	}
+
+	var (
+		headers     []displayHeader
+		received    []string
+		claimedAuth []mailauth.HeaderField
+	)
+
+	decoder := new(mime.WordDecoder)
+	for _, field := range mailauth.Headers([]byte(rawEmail.Content)) {
+		header := displayHeader{HeaderField: field}
+		if decoded, err := decoder.DecodeHeader(field.Value); err == nil && decoded != field.Value {
+			header.Decoded = decoded
+		}
+		headers = append(headers, header)
+
+		switch strings.ToLower(field.Name) {
+		case "received":
+			// Each server adds its Received header on top, so the first
+			// hop is at the bottom
+			received = append([]string{field.Value}, received...)
+		case "authentication-results", "arc-authentication-results", "received-spf":
+			// These were already on the email, so they could say anything
+			claimedAuth = append(claimedAuth, field)
+		}
+	}
+
+	tls := ""
+	if rawEmail.TLSVersion != "" {
+		tls = rawEmail.TLSVersion + ", " + rawEmail.TLSCipher
+	}
+
+	securityHeaders(c, "default-src 'none'; style-src 'unsafe-inline'; form-action 'none'; base-uri 'none'; frame-ancestors 'none'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(200)
+
+	err := headersTemplate.Execute(c.Writer, map[string]interface{}{
+		"Subject":     email.Subject,
+		"ViewURL":     "/" + rawEmail.ID,
+		"RawURL":      "/" + rawEmail.ID + "/raw",
+		"Banner":      authBanner(rawEmail.AuthVerdict),
+		"AuthResults": rawEmail.AuthResults,
+		"ClaimedAuth": claimedAuth,
+		"TLS":         tls,
+		"Received":    received,
+		"Headers":     headers,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Downloads the email exactly as it was received
+func handleRaw(c *gin.Context) {
+	rawEmail, _, ok := findEmail(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": rawEmail.ID + ".eml"}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(200, "message/rfc822", []byte(rawEmail.Content))
+}
@@ -0,0 +1,165 @@
+package slackevents
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+)
+
+// Slack caps views at 100 blocks, and each address takes up four
+const maxHomeAddresses = 20
+
+// How many subjects to show under each address
+const homeRecentEmails = 3
+
+// Builds and publishes a user's App Home tab
+func publishHome(user string) error {
+	var addresses []db.Address
+	tx := db.DB.Where("\"user\" = ? AND expires_at > ?", user, time.Now().Add(-7*24*time.Hour)).Order("created_at DESC").Limit(maxHomeAddresses).Find(&addresses)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, "your temporary addresses", false, false)),
+	}
+
+	if len(addresses) == 0 {
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "you don't have any addresses right now. run `/tempmail new` to get one!", false, false), nil, nil))
+	}
+
+	counts, recents, domains, err := homeDetails(addresses)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		count, recent := counts[address.ID], recents[address.ID]
+
+		messages := fmt.Sprintf("%d messages", count)
+		if count == 1 {
+			messages = "1 message"
+		}
+
+		blocks = append(blocks,
+			slack.NewDividerBlock(),
+			slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*%s*\n%s · <%s|%s>", fullAddress(address), formatExpiry(address.ExpiresAt), InboxURL(address), messages), false, false), nil, nil),
+		)
+
+		if len(recent) > 0 {
+			var lines []string
+			for _, email := range recent {
+				subject := email.Subject
+				if subject == "" {
+					subject = "no subject"
+				}
+				tag := ""
+				if email.Tag != "" {
+					tag = fmt.Sprintf(" `+%s`", strings.ReplaceAll(email.Tag, "`", ""))
+				}
+				lines = append(lines, fmt.Sprintf("• <%s|%s> from %s%s", viewURL(email.ID), util.SanitizeInput(subject), util.SanitizeInput(email.From), util.SanitizeInput(tag)))
+			}
+
+			blocks = append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, strings.Join(lines, "\n"), false, false)))
+		}
+
+		domain, ok := domains[strings.ToLower(address.Domain)]
+		if !ok {
+			domain = db.Domain{Name: address.Domain}
+		}
+		defaultTTL, _ := lifetimeLimits(domain)
+
+		if address.ExpiresAt.After(time.Now()) {
+			deactivate := slack.NewButtonBlockElement("home_deactivate", address.ID, slack.NewTextBlockObject(slack.PlainTextType, "Deactivate", false, false)).WithStyle(slack.StyleDanger)
+			deactivate.Confirm = slack.NewConfirmationBlockObject(
+				slack.NewTextBlockObject(slack.PlainTextType, "Deactivate address?", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("%s will stop receiving mail right away.", fullAddress(address)), false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Deactivate", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+			)
+
+			blocks = append(blocks, slack.NewActionBlock("home_actions_"+address.ID,
+				slack.NewButtonBlockElement("home_extend", address.ID, slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("Extend %s", util.FormatDuration(defaultTTL)), false, false)),
+				lifetimeSelect("home_extend_for", address),
+				deactivate,
+			))
+		} else {
+			blocks = append(blocks, slack.NewActionBlock("home_actions_"+address.ID,
+				slack.NewButtonBlockElement("home_extend", address.ID, slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("Get another %s", util.FormatDuration(defaultTTL)), false, false)).WithStyle(slack.StylePrimary),
+				lifetimeSelect("home_extend_for", address),
+			))
+		}
+	}
+
+	_, err = Client.PublishView(user, slack.HomeTabViewRequest{
+		Type:   slack.VTHomeTab,
+		Blocks: slack.Blocks{BlockSet: blocks},
+	}, "")
+	return err
+}
+
+// Looks up everything the Home tab shows for a set of addresses in one query
+// each, instead of a few per address: how many emails they've got, the most
+// recent ones, and their domains by name
+func homeDetails(addresses []db.Address) (map[string]int64, map[string][]db.Email, map[string]db.Domain, error) {
+	counts := map[string]int64{}
+	recents := map[string][]db.Email{}
+	domains := map[string]db.Domain{}
+	if len(addresses) == 0 {
+		return counts, recents, domains, nil
+	}
+
+	var ids, names []string
+	for _, address := range addresses {
+		ids = append(ids, address.ID)
+		names = append(names, strings.ToLower(address.Domain))
+	}
+
+	var rows []struct {
+		AddressID string
+		Count     int64
+	}
+	tx := db.DB.Model(&db.Email{}).Select("address_id, count(*) AS count").Where("address_id IN ?", ids).Group("address_id").Scan(&rows)
+	if tx.Error != nil {
+		return nil, nil, nil, tx.Error
+	}
+	for _, row := range rows {
+		counts[row.AddressID] = row.Count
+	}
+
+	ranked := db.DB.Model(&db.Email{}).
+		Select(`id, address_id, created_at, "from", subject, tag, row_number() OVER (PARTITION BY address_id ORDER BY created_at DESC) AS n`).
+		Where("address_id IN ?", ids)
+	var recent []db.Email
+	tx = db.DB.Table("(?) AS ranked", ranked).Where("n <= ?", homeRecentEmails).Order("created_at DESC").Find(&recent)
+	if tx.Error != nil {
+		return nil, nil, nil, tx.Error
+	}
+	for _, email := range recent {
+		recents[email.AddressID] = append(recents[email.AddressID], email)
+	}
+
+	// Domains that have since been removed just fall back to global settings
+	var found []db.Domain
+	if tx := db.DB.Where("name IN ?", names).Find(&found); tx.Error != nil {
+		return nil, nil, nil, tx.Error
+	}
+	for _, domain := range found {
+		domains[domain.Name] = domain
+	}
+
+	return counts, recents, domains, nil
+}
+
+// Keeps the Home tab in sync after an address changes. Failures aren't worth
+// bubbling up since the tab gets rebuilt every time it's opened anyway.
+func refreshHome(user string) {
+	if err := publishHome(user); err != nil {
+		log.Println(err)
+	}
+}
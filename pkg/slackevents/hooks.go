@@ -0,0 +1,364 @@
+package slackevents
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/cjdenio/temp-email/pkg/webhooks"
+	"github.com/gin-gonic/gin"
+	"github.com/slack-go/slack"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvalidWebhookURL = errors.New("invalid webhook url")
+	errWebhookNotFound   = errors.New("webhook not found")
+)
+
+// How many deliveries are shown for a webhook
+const webhookDeliveriesLimit = 50
+
+// Registers a webhook for one of user's addresses, or all of them if
+// addressID is empty
+func createWebhook(user, rawURL, addressID string) (db.Webhook, error) {
+	u, err := safehttp.CheckURL(rawURL)
+	if err == safehttp.ErrInvalidURL {
+		return db.Webhook{}, errInvalidWebhookURL
+	} else if err != nil {
+		return db.Webhook{}, err
+	}
+
+	if addressID != "" {
+		var count int64
+		if tx := db.DB.Model(&db.Address{}).Where("id = ? AND \"user\" = ?", addressID, user).Count(&count); tx.Error != nil {
+			return db.Webhook{}, tx.Error
+		} else if count == 0 {
+			return db.Webhook{}, gorm.ErrRecordNotFound
+		}
+	}
+
+	hook := db.Webhook{
+		User:      user,
+		AddressID: addressID,
+		URL:       u.String(),
+		Secret:    webhooks.NewSecret(),
+	}
+	if tx := db.DB.Create(&hook); tx.Error != nil {
+		return db.Webhook{}, tx.Error
+	}
+
+	return hook, nil
+}
+
+func findWebhook(user, id string) (db.Webhook, error) {
+	var hook db.Webhook
+
+	n, err := strconv.ParseUint(strings.TrimPrefix(id, "#"), 10, 64)
+	if err != nil {
+		return hook, errWebhookNotFound
+	}
+
+	tx := db.DB.Where("id = ? AND \"user\" = ?", n, user).First(&hook)
+	if tx.Error == gorm.ErrRecordNotFound {
+		return hook, errWebhookNotFound
+	}
+	return hook, tx.Error
+}
+
+// Queues every failed delivery for a webhook to be sent again
+func replayFailedDeliveries(hook db.Webhook) (int, error) {
+	var deliveries []db.WebhookDelivery
+	if tx := db.DB.Where("webhook_id = ? AND status = ?", hook.ID, db.DeliveryFailed).Find(&deliveries); tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	for i := range deliveries {
+		if err := webhooks.Replay(&deliveries[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+func webhookScope(hook db.Webhook) string {
+	if hook.AddressID == "" {
+		return "all your addresses"
+	}
+	return "`" + hook.AddressID + "`"
+}
+
+// Handles /tempmail webhook <add|list|remove|replay>
+func commandWebhook(cmd slack.SlashCommand, args []string) slack.Msg {
+	usage := "try `/tempmail webhook add <url> [address]`, `/tempmail webhook list`, `/tempmail webhook remove <id>` or `/tempmail webhook replay <id>`"
+	if len(args) == 0 {
+		return ephemeral(usage)
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 2 {
+			return ephemeral("where to? try `/tempmail webhook add <url> [address]`")
+		}
+
+		addressID := ""
+		if len(args) > 2 {
+			addressID = strings.ToLower(strings.SplitN(unlinkText(args[2]), "@", 2)[0])
+		}
+
+		hook, err := createWebhook(cmd.UserID, unlinkText(args[1]), addressID)
+		if err == errInvalidWebhookURL {
+			return ephemeral("that doesn't look like an http(s) URL :thinking_face:")
+		} else if err == safehttp.ErrBlockedHost {
+			return ephemeral("webhooks can't point at private or local addresses :no_entry_sign:")
+		} else if err == gorm.ErrRecordNotFound {
+			return ephemeral(fmt.Sprintf("you don't have an address called `%s` :thinking_face:", addressID))
+		} else if err != nil {
+			log.Println(err)
+			return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		}
+
+		return ephemeral(fmt.Sprintf("webhook #%d will get emails sent to %s. payloads are signed with this secret, which i won't show again:\n\n`%s`\n\ncheck the `X-Webhook-Signature` header against an HMAC-SHA256 of `X-Webhook-Timestamp`, a period, and the body.", hook.ID, webhookScope(hook), hook.Secret))
+	case "list":
+		var hooks []db.Webhook
+		if tx := db.DB.Where("\"user\" = ?", cmd.UserID).Order("id").Find(&hooks); tx.Error != nil {
+			log.Println(tx.Error)
+			return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		}
+
+		if len(hooks) == 0 {
+			return ephemeral("you don't have any webhooks. try `/tempmail webhook add <url>`!")
+		}
+
+		lines := []string{"*your webhooks:*"}
+		for _, hook := range hooks {
+			var failed int64
+			db.DB.Model(&db.WebhookDelivery{}).Where("webhook_id = ? AND status = ?", hook.ID, db.DeliveryFailed).Count(&failed)
+
+			line := fmt.Sprintf("• #%d %s for %s", hook.ID, util.SanitizeInput(hook.URL), webhookScope(hook))
+			if failed > 0 {
+				line += fmt.Sprintf(", :warning: %d failed deliveries", failed)
+			}
+			lines = append(lines, line)
+		}
+
+		return ephemeral(strings.Join(lines, "\n"))
+	case "remove", "replay":
+		if len(args) < 2 {
+			return ephemeral(fmt.Sprintf("which webhook? try `/tempmail webhook %s <id>`", strings.ToLower(args[0])))
+		}
+
+		hook, err := findWebhook(cmd.UserID, args[1])
+		if err == errWebhookNotFound {
+			return ephemeral(fmt.Sprintf("you don't have a webhook %s :thinking_face:", args[1]))
+		} else if err != nil {
+			log.Println(err)
+			return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		}
+
+		if strings.ToLower(args[0]) == "replay" {
+			n, err := replayFailedDeliveries(hook)
+			if err != nil {
+				log.Println(err)
+				return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+			}
+			return ephemeral(fmt.Sprintf("retrying %d failed deliveries to webhook #%d", n, hook.ID))
+		}
+
+		if tx := db.DB.Delete(&hook); tx.Error != nil {
+			log.Println(tx.Error)
+			return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		}
+		return ephemeral(fmt.Sprintf("webhook #%d has been removed", hook.ID))
+	default:
+		return ephemeral(fmt.Sprintf("unfortunately i don't know how to _\"webhook %s\"_. %s", args[0], usage))
+	}
+}
+
+type apiWebhook struct {
+	ID        uint   `json:"id"`
+	URL       string `json:"url"`
+	AddressID string `json:"address_id,omitempty"`
+
+	// Only included when the webhook is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type apiDelivery struct {
+	ID            uint       `json:"id"`
+	EmailID       string     `json:"email_id"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+func toAPIDelivery(delivery db.WebhookDelivery) apiDelivery {
+	d := apiDelivery{
+		ID:          delivery.ID,
+		EmailID:     delivery.EmailID,
+		Status:      delivery.Status,
+		Attempts:    delivery.Attempts,
+		CreatedAt:   delivery.CreatedAt,
+		LastStatus:  delivery.LastStatus,
+		LastError:   delivery.LastError,
+		DeliveredAt: delivery.DeliveredAt,
+	}
+	if delivery.Status == db.DeliveryPending {
+		d.NextAttemptAt = &delivery.NextAttemptAt
+	}
+	return d
+}
+
+func registerWebhookRoutes(api *gin.RouterGroup) {
+	api.GET("/webhooks", apiListWebhooks)
+	api.POST("/webhooks", apiCreateWebhook)
+	api.DELETE("/webhooks/:id", apiDeleteWebhook)
+	api.GET("/webhooks/:id/deliveries", apiListDeliveries)
+	api.POST("/webhooks/:id/deliveries/:delivery/replay", apiReplayDelivery)
+}
+
+// Looks up the :id webhook, making sure it belongs to the caller
+func apiFindWebhook(c *gin.Context) (db.Webhook, bool) {
+	hook, err := findWebhook(c.GetString("user"), c.Param("id"))
+	if err == errWebhookNotFound {
+		apiFail(c, http.StatusNotFound, "webhook not found")
+		return hook, false
+	} else if err != nil {
+		log.Println(err)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return hook, false
+	}
+	return hook, true
+}
+
+func apiListWebhooks(c *gin.Context) {
+	var hooks []db.Webhook
+	if tx := db.DB.Where("\"user\" = ?", c.GetString("user")).Order("id").Find(&hooks); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	result := []apiWebhook{}
+	for _, hook := range hooks {
+		result = append(result, apiWebhook{ID: hook.ID, URL: hook.URL, AddressID: hook.AddressID})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func apiCreateWebhook(c *gin.Context) {
+	var body struct {
+		URL string `json:"url"`
+
+		// Leave empty to get emails for all your addresses
+		AddressID string `json:"address_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apiFail(c, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	hook, err := createWebhook(c.GetString("user"), body.URL, strings.ToLower(body.AddressID))
+	if err == errInvalidWebhookURL {
+		apiFail(c, http.StatusBadRequest, "url must be an http(s) URL")
+		return
+	} else if err == safehttp.ErrBlockedHost {
+		apiFail(c, http.StatusBadRequest, "url can't point at a private address")
+		return
+	} else if err == gorm.ErrRecordNotFound {
+		apiFail(c, http.StatusNotFound, "address not found")
+		return
+	} else if err != nil {
+		log.Println(err)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	c.JSON(http.StatusCreated, apiWebhook{ID: hook.ID, URL: hook.URL, AddressID: hook.AddressID, Secret: hook.Secret})
+}
+
+func apiDeleteWebhook(c *gin.Context) {
+	hook, ok := apiFindWebhook(c)
+	if !ok {
+		return
+	}
+
+	if tx := db.DB.Delete(&hook); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Lists a webhook's recent deliveries, optionally filtered with ?status=
+func apiListDeliveries(c *gin.Context) {
+	hook, ok := apiFindWebhook(c)
+	if !ok {
+		return
+	}
+
+	query := db.DB.Where("webhook_id = ?", hook.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var deliveries []db.WebhookDelivery
+	if tx := query.Order("id DESC").Limit(webhookDeliveriesLimit).Find(&deliveries); tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	result := []apiDelivery{}
+	for _, delivery := range deliveries {
+		result = append(result, toAPIDelivery(delivery))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func apiReplayDelivery(c *gin.Context) {
+	hook, ok := apiFindWebhook(c)
+	if !ok {
+		return
+	}
+
+	// Anything that isn't an ID can't match a delivery, and shouldn't reach
+	// the database
+	id, err := strconv.ParseUint(c.Param("delivery"), 10, 64)
+	if err != nil {
+		apiFail(c, http.StatusNotFound, "delivery not found")
+		return
+	}
+
+	var delivery db.WebhookDelivery
+	tx := db.DB.Where("id = ? AND webhook_id = ?", id, hook.ID).First(&delivery)
+	if tx.Error == gorm.ErrRecordNotFound {
+		apiFail(c, http.StatusNotFound, "delivery not found")
+		return
+	} else if tx.Error != nil {
+		log.Println(tx.Error)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	if err := webhooks.Replay(&delivery); err != nil {
+		log.Println(err)
+		apiFail(c, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, toAPIDelivery(delivery))
+}
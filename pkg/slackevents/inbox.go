@@ -0,0 +1,151 @@
+package slackevents
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/config"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/signing"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var inboxTemplate = template.Must(template.New("inbox").Funcs(template.FuncMap{
+	"size": util.FormatSize,
+	"time": func(t time.Time) string {
+		return t.UTC().Format("Jan 2, 2006 15:04 UTC")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{.Address}}</title>
+<style>
+body { font-family: sans-serif; max-width: 900px; margin: 0 auto; padding: 16px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 8px; border-bottom: 1px solid #ccc; vertical-align: top; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Address}}</h1>
+<p class="muted">{{if .Expired}}expired{{else}}expires{{end}} {{time .ExpiresAt}}</p>
+{{if .Emails}}
+<table>
+<tr><th>From</th><th>Subject</th><th>Received</th></tr>
+{{range .Emails}}
+<tr>
+<td>{{.From}}{{if .Tag}} <span class="muted">+{{.Tag}}</span>{{end}}</td>
+<td>
+<a href="{{.URL}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a>
+{{range .Attachments}}<br>📎 <a href="{{.URL}}">{{.Filename}}</a> <span class="muted">({{size .Size}})</span>{{end}}
+</td>
+<td>{{time .CreatedAt}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No emails yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+type inboxEmail struct {
+	db.Email
+	URL         string
+	Attachments []inboxAttachment
+}
+
+type inboxAttachment struct {
+	db.Attachment
+	URL string
+}
+
+func inboxSigningMessage(addressID string) string {
+	return "inbox|" + addressID
+}
+
+// InboxURL links to a page listing every email an address has received. The
+// link is signed and stops working after INBOX_LINK_TTL.
+func InboxURL(address db.Address) string {
+	query := signing.Query(inboxSigningMessage(address.ID), time.Now().Add(config.InboxLinkTTL))
+	return fmt.Sprintf("%s/inbox/%s?%s", os.Getenv("APP_DOMAIN"), address.ID, query.Encode())
+}
+
+func attachmentURL(attachment db.Attachment) string {
+	return fmt.Sprintf("%s/%s/attachments/%s", os.Getenv("APP_DOMAIN"), attachment.EmailID, attachment.ID)
+}
+
+func handleInbox(c *gin.Context) {
+	if !signing.VerifyQuery(inboxSigningMessage(c.Param("address")), c.Request.URL.Query()) {
+		c.String(403, "this link is invalid or has expired. grab a fresh one from slack!")
+		return
+	}
+
+	var address db.Address
+	tx := db.DB.Where("id = ?", c.Param("address")).First(&address)
+	if tx.Error == gorm.ErrRecordNotFound {
+		c.String(404, "404 address not found :(")
+		return
+	} else if tx.Error != nil {
+		log.Println(tx.Error)
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return
+	}
+
+	var emails []db.Email
+	tx = db.DB.Select("id", "created_at", "from", "subject", "tag").Where("address_id = ?", address.ID).Order("created_at DESC").Find(&emails)
+	if tx.Error != nil {
+		log.Println(tx.Error)
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return
+	}
+
+	var attachments []db.Attachment
+	if len(emails) > 0 {
+		emailIDs := make([]string, len(emails))
+		for i, email := range emails {
+			emailIDs[i] = email.ID
+		}
+
+		tx = db.DB.Where("email_id IN ?", emailIDs).Order("filename").Find(&attachments)
+		if tx.Error != nil {
+			log.Println(tx.Error)
+			c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+			return
+		}
+	}
+
+	byEmail := map[string][]inboxAttachment{}
+	for _, attachment := range attachments {
+		byEmail[attachment.EmailID] = append(byEmail[attachment.EmailID], inboxAttachment{Attachment: attachment, URL: attachmentURL(attachment)})
+	}
+
+	data := struct {
+		Address   string
+		ExpiresAt time.Time
+		Expired   bool
+		Emails    []inboxEmail
+	}{
+		Address:   fullAddress(address),
+		ExpiresAt: address.ExpiresAt,
+		Expired:   !address.ExpiresAt.After(time.Now()),
+	}
+	for _, email := range emails {
+		data.Emails = append(data.Emails, inboxEmail{Email: email, URL: viewURL(email.ID), Attachments: byEmail[email.ID]})
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Status(200)
+	if err := inboxTemplate.Execute(c.Writer, data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,215 @@
+package slackevents
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/mailauth"
+	"github.com/cjdenio/temp-email/pkg/notify"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+)
+
+func init() {
+	notify.Register(notify.Slack, func(string) notify.Notifier { return slackNotifier{} }, nil)
+}
+
+// Slack's limits on section text and on blocks per message
+const (
+	maxSectionLength    = 3000
+	maxBlocksPerMessage = 50
+
+	// How many messages a single email is allowed to span in a thread
+	maxMessagesPerEmail = 3
+)
+
+// Posts in the thread the address was issued in
+type slackNotifier struct{}
+
+// Describes the tag an email was sent to, for the Slack post header
+func tagText(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (tagged `%s`)", util.SanitizeInput(strings.ReplaceAll(tag, "`", "")))
+}
+
+// Converts an email's body to Slack's flavor of markdown
+func slackBody(email notify.Mail) string {
+	if email.Parsed.HTMLBody == "" {
+		return email.Parsed.TextBody
+	}
+
+	converter := md.NewConverter("", true, &md.Options{
+		StrongDelimiter: "*",
+		EmDelimiter:     "_",
+	})
+
+	converter.AddRules(
+		md.Rule{
+			Filter: []string{"a"},
+			Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
+				return md.String(fmt.Sprintf("<%s|%s>", selec.AttrOr("href", content), content))
+			},
+		},
+		md.Rule{
+			Filter: []string{"h1", "h2", "h3", "h4", "h5", "h6"},
+			Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
+				return md.String("\n\n*" + content + "*\n\n")
+			},
+		},
+		md.Rule{
+			Filter: []string{"img"},
+			Replacement: func(content string, selec *goquery.Selection, options *md.Options) *string {
+				return md.String("")
+			},
+		},
+	)
+
+	body, err := converter.ConvertString(email.Parsed.HTMLBody)
+	if err != nil {
+		log.Println(err)
+		return email.Parsed.TextBody
+	}
+	return body
+}
+
+func (slackNotifier) NewMail(mail notify.Mail) error {
+	address := mail.Address
+
+	subject := "_no subject_"
+	if mail.Email.Subject != "" {
+		subject = fmt.Sprintf("subject: *%s*", mail.Email.Subject)
+	}
+
+	var attachmentLines []string
+	for _, a := range mail.Attachments {
+		attachmentLines = append(attachmentLines, fmt.Sprintf("• <%s|%s> (%s)", attachmentURL(a.Attachment), util.SanitizeInput(a.Filename), util.FormatSize(a.Size)))
+	}
+
+	emailURL := viewURL(mail.Email.ID)
+
+	header := []slack.Block{
+		slack.NewSectionBlock(
+			slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("message from %s%s\n%s\n%s", mail.Email.From, tagText(mail.Email.Tag), util.SanitizeInput(subject), mailauth.Badge(mail.Email.AuthVerdict)), false, false),
+			nil,
+			nil,
+		),
+		slack.NewDividerBlock(),
+	}
+
+	var body []slack.Block
+	for _, chunk := range util.ChunkText(util.SanitizeInput(slackBody(mail)), maxSectionLength) {
+		body = append(body, slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", chunk, false, false), nil, nil))
+	}
+
+	footer := []slack.Block{slack.NewDividerBlock()}
+
+	if len(attachmentLines) > 0 {
+		for i, chunk := range util.ChunkText(strings.Join(attachmentLines, "\n"), maxSectionLength-len(":paperclip: *attachments*\n")) {
+			if i == 0 {
+				chunk = ":paperclip: *attachments*\n" + chunk
+			}
+			footer = append(footer, slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", chunk, false, false), nil, nil))
+		}
+		footer = append(footer, slack.NewDividerBlock())
+	}
+
+	footer = append(footer, slack.NewContextBlock("",
+		slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("Not rendering properly? Click <%s|here> to view this email in your browser. You can also see <%s|everything this address has received>.", emailURL, InboxURL(address)), false, false),
+		slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("<%s/headers|Headers> · <%s/raw|Download .eml>", emailURL, emailURL), false, false),
+	))
+	if outbound != nil {
+		footer = append(footer, slack.NewContextBlock("",
+			slack.NewTextBlockObject("mrkdwn", "Reply to the latest email by starting a message in this thread with `reply:`, or to this one with the _Reply to email_ shortcut.", false, false),
+		))
+	}
+
+	// Give up on really long emails rather than flooding the thread
+	if room := maxMessagesPerEmail*maxBlocksPerMessage - len(header) - len(footer) - 1; len(body) > room {
+		body = append(body[:room], slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", fmt.Sprintf(":scissors: truncated, <%s|view the full email>", emailURL), false, false)))
+	}
+
+	blocks := append(append(header, body...), footer...)
+
+	// Anything that doesn't fit in one message continues in follow-up replies
+	for first := true; len(blocks) > 0; first = false {
+		n := len(blocks)
+		if n > maxBlocksPerMessage {
+			n = maxBlocksPerMessage
+		}
+
+		_, ts, err := Client.PostMessage(
+			address.Channel,
+			slack.MsgOptionDisableLinkUnfurl(),
+			slack.MsgOptionDisableMediaUnfurl(),
+			slack.MsgOptionTS(address.Timestamp),
+			slack.MsgOptionBlocks(blocks[:n]...),
+		)
+		if err != nil {
+			return err
+		}
+
+		// The first message is the one the reply shortcut gets used on
+		if first {
+			db.DB.Model(&db.Email{}).Where("id = ?", mail.Email.ID).Update("slack_timestamp", ts)
+		}
+
+		blocks = blocks[n:]
+	}
+
+	// Small attachments can go straight into the thread as well
+	maxUpload, _ := strconv.ParseInt(os.Getenv("SLACK_UPLOAD_MAX_BYTES"), 10, 64)
+	for _, a := range mail.Attachments {
+		if maxUpload <= 0 || int64(len(a.Data)) > maxUpload {
+			continue
+		}
+
+		_, err := Client.UploadFile(slack.FileUploadParameters{
+			Reader:          bytes.NewReader(a.Data),
+			Filename:        a.Filename,
+			Title:           a.Filename,
+			Channels:        []string{address.Channel},
+			ThreadTimestamp: address.Timestamp,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func (slackNotifier) Expired(address db.Address) error {
+	_, _, err := Client.PostMessage(
+		address.Channel,
+		slack.MsgOptionText(":x: :clock1: this address has expired, so it will no longer receive mail.", false),
+		slack.MsgOptionTS(address.Timestamp),
+		slack.MsgOptionBlocks(ExpiredBlocks(address)...))
+	if err != nil {
+		return err
+	}
+
+	Client.AddReaction("clock1", slack.ItemRef{
+		Channel:   address.Channel,
+		Timestamp: address.Timestamp,
+	})
+	return nil
+}
+
+func (slackNotifier) Deactivated(address db.Address, reason string) error {
+	_, _, err := Client.PostMessage(
+		address.Channel,
+		slack.MsgOptionText(fmt.Sprintf(":x: %s, this address has been deactivated.", reason), false),
+		slack.MsgOptionTS(address.Timestamp),
+	)
+	return err
+}
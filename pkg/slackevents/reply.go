@@ -0,0 +1,213 @@
+package slackevents
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/relay"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// Where replies written in Slack are sent out, nil if they can't be
+var outbound *relay.Relay
+
+const (
+	// The message shortcut on posted emails, and the modal it opens
+	replyCallbackID = "reply_email"
+
+	replyBlockID  = "reply"
+	replyActionID = "text"
+)
+
+var (
+	errRepliesDisabled = errors.New("replies disabled")
+	errNotYourAddress  = errors.New("not your address")
+	errAddressExpired  = errors.New("address expired")
+	errEmptyReply      = errors.New("empty reply")
+)
+
+// Sends a reply to an email from the address it was sent to, and lets the
+// thread know
+func sendReply(address db.Address, email db.Email, user, text string) error {
+	if outbound == nil {
+		return errRepliesDisabled
+	}
+	if user != address.User {
+		return errNotYourAddress
+	}
+	if !address.ExpiresAt.After(time.Now()) {
+		return errAddressExpired
+	}
+	if strings.TrimSpace(text) == "" {
+		return errEmptyReply
+	}
+
+	original, err := parsemail.Parse(strings.NewReader(email.Content))
+	if err != nil {
+		return err
+	}
+
+	reply, err := relay.NewReply(fullAddress(address), original, text)
+	if err != nil {
+		return err
+	}
+	if err := outbound.Send(reply.From, reply.To, reply.Message); err != nil {
+		return err
+	}
+
+	subject := email.Subject
+	if subject == "" {
+		subject = "no subject"
+	}
+	Client.PostMessage(
+		address.Channel,
+		slack.MsgOptionText(fmt.Sprintf(":outbox_tray: <@%s> replied to %s about _%s_", user, util.SanitizeInput(strings.Join(reply.To, ", ")), util.SanitizeInput(subject)), false),
+		slack.MsgOptionTS(address.Timestamp),
+	)
+
+	return nil
+}
+
+// Turns a sendReply error into something to tell the user
+func replyErrorText(err error) string {
+	switch err {
+	case errRepliesDisabled:
+		return "sorry, i'm not set up to send replies :pensive:"
+	case errNotYourAddress:
+		return "whatcha tryin' to pull here :face_with_raised_eyebrow: only the address's owner can reply from it"
+	case errAddressExpired:
+		return "this address has expired, extend it first if you want to reply from it"
+	case errEmptyReply:
+		return "what do you want to say? try `reply: sounds good!`"
+	case relay.ErrNoRecipient:
+		return "i can't tell who sent that email, so there's nobody to reply to :thinking_face:"
+	default:
+		return "aaaaaaaaaaaaaaaaaaaa something went wrong, your reply wasn't sent"
+	}
+}
+
+// Handles "reply: ..." in an address's thread, which replies to the latest
+// email it received
+func replyFromThread(ev *slackevents.MessageEvent) {
+	var address db.Address
+	if tx := db.DB.Where("channel = ? AND timestamp = ?", ev.Channel, ev.ThreadTimeStamp).First(&address); tx.Error != nil {
+		return
+	}
+
+	fail := func(text string) {
+		Client.PostEphemeral(ev.Channel, ev.User, slack.MsgOptionTS(ev.ThreadTimeStamp), slack.MsgOptionText(text, false))
+	}
+
+	var email db.Email
+	if tx := db.DB.Where("address_id = ?", address.ID).Order("created_at DESC").First(&email); tx.Error != nil {
+		fail("this address hasn't received any emails to reply to yet")
+		return
+	}
+
+	// Slack escapes &, < and > and turns links into <url|text>
+	text := strings.TrimSpace(ev.Text)
+	text = html.UnescapeString(unlinkText(strings.TrimSpace(text[len("reply:"):])))
+
+	if err := sendReply(address, email, ev.User, text); err != nil {
+		log.Println(err)
+		fail(replyErrorText(err))
+		return
+	}
+
+	Client.AddReaction("outbox_tray", slack.ItemRef{
+		Channel:   ev.Channel,
+		Timestamp: ev.TimeStamp,
+	})
+}
+
+func isReplyMessage(ev *slackevents.MessageEvent) bool {
+	return ev.SubType == "" && ev.ThreadTimeStamp != "" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(ev.Text)), "reply:")
+}
+
+// Opens the reply modal for the email a message shortcut was used on
+func openReplyModal(payload slack.InteractionCallback) {
+	fail := func(text string) {
+		Client.PostEphemeral(payload.Channel.ID, payload.User.ID, slack.MsgOptionTS(payload.Message.ThreadTimestamp), slack.MsgOptionText(text, false))
+	}
+
+	var email db.Email
+	if tx := db.DB.Where("slack_timestamp = ?", payload.Message.Timestamp).First(&email); tx.Error != nil {
+		fail("that's not an email i can reply to :thinking_face: try it on the first message of an email i posted")
+		return
+	}
+
+	var address db.Address
+	if tx := db.DB.Where("id = ?", email.AddressID).First(&address); tx.Error != nil {
+		log.Println(tx.Error)
+		fail("aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return
+	}
+
+	// Check what we can before they write anything
+	if outbound == nil {
+		fail(replyErrorText(errRepliesDisabled))
+		return
+	} else if payload.User.ID != address.User {
+		fail(replyErrorText(errNotYourAddress))
+		return
+	} else if !address.ExpiresAt.After(time.Now()) {
+		fail(replyErrorText(errAddressExpired))
+		return
+	}
+
+	subject := email.Subject
+	if subject == "" {
+		subject = "no subject"
+	}
+
+	input := slack.NewPlainTextInputBlockElement(slack.NewTextBlockObject(slack.PlainTextType, "Write your reply", false, false), replyActionID)
+	input.Multiline = true
+
+	_, err := Client.OpenView(payload.TriggerID, slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      replyCallbackID,
+		PrivateMetadata: email.ID,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Reply to email", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Send", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewContextBlock("",
+				slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("replying to %s about _%s_, from %s", util.SanitizeInput(email.From), util.SanitizeInput(subject), fullAddress(address)), false, false),
+			),
+			slack.NewInputBlock(replyBlockID, slack.NewTextBlockObject(slack.PlainTextType, "Reply", false, false), input),
+		}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Sends the reply from a submitted reply modal
+func submitReplyModal(payload slack.InteractionCallback) {
+	var email db.Email
+	if tx := db.DB.Where("id = ?", payload.View.PrivateMetadata).First(&email); tx.Error != nil {
+		log.Println(tx.Error)
+		return
+	}
+
+	var address db.Address
+	if tx := db.DB.Where("id = ?", email.AddressID).First(&address); tx.Error != nil {
+		log.Println(tx.Error)
+		return
+	}
+
+	text := payload.View.State.Values[replyBlockID][replyActionID].Value
+
+	if err := sendReply(address, email, payload.User.ID, text); err != nil {
+		log.Println(err)
+		Client.PostEphemeral(address.Channel, payload.User.ID, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText(replyErrorText(err), false))
+	}
+}
@@ -1,19 +1,21 @@
 package slackevents
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
-	"time"
 
-	"github.com/DusanKasan/parsemail"
 	"github.com/cjdenio/temp-email/pkg/db"
-	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/cjdenio/temp-email/pkg/imageproxy"
+	"github.com/cjdenio/temp-email/pkg/mailauth"
+	"github.com/cjdenio/temp-email/pkg/relay"
+	"github.com/cjdenio/temp-email/pkg/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
@@ -23,31 +25,50 @@ import (
 var Client *slack.Client
 
 func topLevelMessage(ev *slackevents.MessageEvent) bool {
-	return ev.Channel == os.Getenv("SLACK_CHANNEL") && ev.ThreadTimeStamp == ""
+	return ev.ThreadTimeStamp == "" && isAddressChannel(ev.Channel)
 }
 
-func Start() {
-	Client = slack.New(os.Getenv("SLACK_TOKEN"))
+// Describes an email's SPF/DKIM/DMARC verdict for the web viewer
+func authBanner(verdict string) string {
+	switch mailauth.Result(verdict) {
+	case mailauth.Pass:
+		return "✅ Sender verified"
+	case mailauth.Fail:
+		return "⚠️ This message failed sender verification and may be spoofed"
+	default:
+		return "❔ Sender could not be verified"
+	}
+}
 
-	r := gin.Default()
+// Reads a request's body and makes sure it actually came from Slack
+func verifyRequest(c *gin.Context) ([]byte, bool) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Writer.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	sv, err := slack.NewSecretsVerifier(c.Request.Header, os.Getenv("SLACK_SIGNING_SECRET"))
+	if err != nil {
+		c.Writer.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	if _, err := sv.Write(body); err != nil {
+		c.Writer.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if err := sv.Ensure(); err != nil {
+		c.Writer.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return body, true
+}
 
+// The HTTP endpoints Slack delivers events, interactions and commands to
+func registerSlackRoutes(r *gin.Engine) {
 	r.POST("/slack/events", func(c *gin.Context) {
-		body, err := ioutil.ReadAll(c.Request.Body)
-		if err != nil {
-			c.Writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		sv, err := slack.NewSecretsVerifier(c.Request.Header, os.Getenv("SLACK_SIGNING_SECRET"))
-		if err != nil {
-			c.Writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if _, err := sv.Write(body); err != nil {
-			c.Writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if err := sv.Ensure(); err != nil {
-			c.Writer.WriteHeader(http.StatusUnauthorized)
+		body, ok := verifyRequest(c)
+		if !ok {
 			return
 		}
 		eventsAPIEvent, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
@@ -67,80 +88,13 @@ func Start() {
 			c.Writer.Write([]byte(r.Challenge))
 		}
 		if eventsAPIEvent.Type == slackevents.CallbackEvent {
-			innerEvent := eventsAPIEvent.InnerEvent
-			switch ev := innerEvent.Data.(type) {
-			case *slackevents.MessageEvent:
-				if ev.SubType == "" && topLevelMessage(ev) && strings.Contains(strings.ToLower(ev.Text), "gib email") {
-					address := util.GenerateEmailAddress()
-
-					err = Client.AddReaction("thumb", slack.ItemRef{
-						Channel:   ev.Channel,
-						Timestamp: ev.TimeStamp,
-					})
-					if err != nil {
-						fmt.Println(err)
-					}
-
-					Client.PostMessage(
-						ev.Channel,
-						slack.MsgOptionText(fmt.Sprintf(`wahoo! your temporary 24-hour email address is %s@%s
-						
-to stop receiving emails, delete your 'gib email' message.
-
-i'll post emails in this thread :arrow_down:`, address, os.Getenv("DOMAIN")), false),
-						slack.MsgOptionTS(ev.TimeStamp),
-					)
-
-					email := db.Address{
-						ID:        address,
-						CreatedAt: time.Now(),
-						ExpiresAt: time.Now().Add(24 * time.Hour),
-						Timestamp: ev.TimeStamp,
-						User:      ev.User,
-					}
-
-					db.DB.Create(&email)
-				} else if ev.SubType == "" && topLevelMessage(ev) && strings.HasPrefix(strings.ToLower(ev.Text), "gib ") {
-					Client.PostMessage(ev.Channel, slack.MsgOptionText(fmt.Sprintf("unfortunately i am unable to _\"gib %s\"_. maybe try _\"gib email\"_?", strings.TrimPrefix(strings.ToLower(ev.Text), "gib ")), false), slack.MsgOptionTS(ev.TimeStamp))
-				} else if (ev.SubType == "message_deleted" || (ev.SubType == "message_changed" && ev.Message.SubType == "tombstone")) && topLevelMessage(ev) {
-					var address db.Address
-					tx := db.DB.Where("timestamp = ? AND expires_at > NOW()", ev.PreviousMessage.TimeStamp).First(&address)
-
-					if tx.Error == nil {
-						address.ExpiresAt = time.Now()
-						address.ExpiredMessageSent = true
-						tx = db.DB.Save(&address)
-						if tx.Error == nil {
-							Client.PostMessage(
-								os.Getenv("SLACK_CHANNEL"),
-								slack.MsgOptionText(":x: since you deleted your message, this address has been deactivated.", false),
-								slack.MsgOptionTS(address.Timestamp),
-							)
-						}
-
-					}
-				}
-			}
+			handleEvent(eventsAPIEvent)
 		}
 	})
 
 	r.POST("/slack/interactivity", func(c *gin.Context) {
-		body, err := ioutil.ReadAll(c.Request.Body)
-		if err != nil {
-			c.Writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		sv, err := slack.NewSecretsVerifier(c.Request.Header, os.Getenv("SLACK_SIGNING_SECRET"))
-		if err != nil {
-			c.Writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if _, err := sv.Write(body); err != nil {
-			c.Writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if err := sv.Ensure(); err != nil {
-			c.Writer.WriteHeader(http.StatusUnauthorized)
+		body, ok := verifyRequest(c)
+		if !ok {
 			return
 		}
 
@@ -156,63 +110,94 @@ i'll post emails in this thread :arrow_down:`, address, os.Getenv("DOMAIN")), fa
 			fmt.Printf("Could not parse action response JSON: %v", err)
 		}
 
-		if payload.ActionCallback.BlockActions[0].ActionID == "reactivate" {
-			id := payload.ActionCallback.BlockActions[0].Value
-			var address db.Address
-			tx := db.DB.Where("id = ? AND expires_at < NOW()", id).First(&address)
-			if tx.Error != nil {
-				return
-			}
-
-			if payload.User.ID != address.User {
-				Client.PostEphemeral(os.Getenv("SLACK_CHANNEL"), payload.User.ID, slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText("whatcha tryin' to pull here :face_with_raised_eyebrow:", false))
-				return
-			}
-
-			address.ExpiresAt = time.Now().Add(24 * time.Hour)
-			address.ExpiredMessageSent = false
+		handleInteraction(payload)
+	})
 
-			db.DB.Save(&address)
+	r.POST("/slack/commands", func(c *gin.Context) {
+		body, ok := verifyRequest(c)
+		if !ok {
+			return
+		}
 
-			Client.PostMessage(os.Getenv("SLACK_CHANNEL"), slack.MsgOptionTS(address.Timestamp), slack.MsgOptionText("This address will be available for another 24 hours!", false))
-			Client.RemoveReaction("clock1", slack.ItemRef{
-				Channel:   os.Getenv("SLACK_CHANNEL"),
-				Timestamp: address.Timestamp,
-			})
+		// The body's already been read, so hand the parser a fresh copy
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cmd, err := slack.SlashCommandParse(c.Request)
+		if err != nil {
+			c.Writer.WriteHeader(http.StatusBadRequest)
+			return
 		}
+
+		c.JSON(200, handleCommand(cmd))
 	})
+}
+
+func Start() {
+	socketMode := os.Getenv("SLACK_SOCKET_MODE") == "true"
+
+	if socketMode {
+		Client = slack.New(os.Getenv("SLACK_TOKEN"), slack.OptionAppLevelToken(os.Getenv("SLACK_APP_TOKEN")))
 
-	r.GET("/:email", func(c *gin.Context) {
-		var rawEmail db.Email
-		tx := db.DB.Where("id = ?", c.Param("email")).First(&rawEmail)
+		go runSocketMode()
+	} else {
+		Client = slack.New(os.Getenv("SLACK_TOKEN"))
+	}
+
+	r := gin.Default()
+
+	if !socketMode {
+		registerSlackRoutes(r)
+	}
+
+	r.GET("/inbox/:address", handleInbox)
+
+	registerAPIRoutes(r)
+
+	outbound = relay.FromEnv()
+
+	imageProxy = imageproxy.New()
+	r.GET(imageproxy.Path, gin.WrapH(imageProxy))
+
+	r.GET("/:email", handleView)
+	r.GET("/:email/body", handleViewBody)
+	r.GET("/:email/embedded", handleEmbedded)
+	r.GET("/:email/headers", handleHeaders)
+	r.GET("/:email/raw", handleRaw)
+
+	r.GET("/:email/attachments/:id", func(c *gin.Context) {
+		var attachment db.Attachment
+		tx := db.DB.Where("id = ? AND email_id = ?", c.Param("id"), c.Param("email")).First(&attachment)
 		if tx.Error == gorm.ErrRecordNotFound {
-			c.String(404, "404 email not found :(")
+			c.String(404, "404 attachment not found :(")
 			return
 		} else if tx.Error != nil {
 			c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
 			return
 		}
 
-		email, err := parsemail.Parse(strings.NewReader(rawEmail.Content))
+		f, err := storage.Open(attachment.StorageKey)
 		if err != nil {
+			log.Println(err)
 			c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
 			return
 		}
+		defer f.Close()
 
-		if email.HTMLBody != "" {
-			c.Header("Content-Type", "text/html; charset=utf-8")
-
-			c.String(200, email.HTMLBody)
-		} else if email.TextBody != "" {
-
-			c.Header("Content-Type", "text/plain; charset=utf-8")
-
-			c.String(200, email.TextBody)
-		} else {
-			c.Header("Content-Type", "text/plain")
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
 
-			c.String(200, "Something went wrong: this message has no content :(")
+		// Always download rather than render, since the content comes from
+		// whoever sent the email
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+		if disposition == "" {
+			disposition = "attachment"
 		}
+
+		c.DataFromReader(200, attachment.Size, contentType, f, map[string]string{
+			"Content-Disposition":    disposition,
+			"X-Content-Type-Options": "nosniff",
+		})
 	})
 
 	log.Println("Starting up HTTP server...")
@@ -0,0 +1,57 @@
+package slackevents
+
+import (
+	"log"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// Receives events, interactions and slash commands over a websocket instead
+// of the /slack/* endpoints, for deployments Slack can't reach
+func runSocketMode() {
+	client := socketmode.New(Client)
+
+	go func() {
+		for evt := range client.Events {
+			switch evt.Type {
+			case socketmode.EventTypeConnecting:
+				log.Println("Connecting to Slack with Socket Mode...")
+			case socketmode.EventTypeConnected:
+				log.Println("Connected to Slack with Socket Mode")
+			case socketmode.EventTypeConnectionError:
+				log.Println("Socket Mode connection failed, retrying...")
+			case socketmode.EventTypeEventsAPI:
+				event, ok := evt.Data.(slackevents.EventsAPIEvent)
+				if !ok {
+					continue
+				}
+				client.Ack(*evt.Request)
+
+				if event.Type == slackevents.CallbackEvent {
+					handleEvent(event)
+				}
+			case socketmode.EventTypeInteractive:
+				payload, ok := evt.Data.(slack.InteractionCallback)
+				if !ok {
+					continue
+				}
+				client.Ack(*evt.Request)
+
+				handleInteraction(payload)
+			case socketmode.EventTypeSlashCommand:
+				cmd, ok := evt.Data.(slack.SlashCommand)
+				if !ok {
+					continue
+				}
+
+				client.Ack(*evt.Request, handleCommand(cmd))
+			}
+		}
+	}()
+
+	if err := client.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
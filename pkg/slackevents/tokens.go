@@ -0,0 +1,117 @@
+package slackevents
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+	"github.com/cjdenio/temp-email/pkg/util"
+	"github.com/slack-go/slack"
+)
+
+// Makes API tokens easy to spot if they end up somewhere they shouldn't
+const apiTokenPrefix = "tm_"
+
+// Handles /tempmail token <new|list|revoke>
+func commandToken(cmd slack.SlashCommand, args []string) slack.Msg {
+	if len(args) == 0 {
+		return ephemeral("try `/tempmail token new [name]`, `/tempmail token list` or `/tempmail token revoke <id>`")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "new":
+		return commandTokenNew(cmd, strings.Join(args[1:], " "))
+	case "list":
+		return commandTokenList(cmd)
+	case "revoke":
+		if len(args) < 2 {
+			return ephemeral("which token? try `/tempmail token revoke <id>`")
+		}
+		return commandTokenRevoke(cmd, args[1])
+	default:
+		return ephemeral(fmt.Sprintf("unfortunately i don't know how to _\"token %s\"_. try `new`, `list` or `revoke`", args[0]))
+	}
+}
+
+func commandTokenNew(cmd slack.SlashCommand, name string) slack.Msg {
+	secret := ids.Secret(apiTokenPrefix)
+
+	token := db.APIToken{
+		User: cmd.UserID,
+		Name: name,
+		Hash: ids.Hash(secret),
+	}
+	if tx := db.DB.Create(&token); tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	return ephemeral(fmt.Sprintf("here's your new API token (#%d). i won't be able to show it again, so keep it somewhere safe!\n\n`%s`\n\nsend it as `Authorization: Bearer <token>` to `%s/api/v1`", token.ID, secret, apiBaseURL()))
+}
+
+func commandTokenList(cmd slack.SlashCommand) slack.Msg {
+	var tokens []db.APIToken
+	if tx := db.DB.Where("\"user\" = ?", cmd.UserID).Order("created_at").Find(&tokens); tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	}
+
+	if len(tokens) == 0 {
+		return ephemeral("you don't have any API tokens. try `/tempmail token new`!")
+	}
+
+	lines := []string{"*your API tokens:*"}
+	for _, token := range tokens {
+		name := token.Name
+		if name == "" {
+			name = "unnamed"
+		}
+
+		used := "never used"
+		if token.LastUsedAt != nil {
+			used = "last used " + util.SlackDate(*token.LastUsedAt)
+		}
+
+		lines = append(lines, fmt.Sprintf("• #%d %s: created %s, %s", token.ID, util.SanitizeInput(name), util.SlackDate(token.CreatedAt), used))
+	}
+
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func commandTokenRevoke(cmd slack.SlashCommand, id string) slack.Msg {
+	n, err := strconv.ParseUint(strings.TrimPrefix(id, "#"), 10, 64)
+	if err != nil {
+		return ephemeral(fmt.Sprintf("_\"%s\"_ doesn't look like a token ID. they look like `#3`", id))
+	}
+
+	tx := db.DB.Where("id = ? AND \"user\" = ?", n, cmd.UserID).Delete(&db.APIToken{})
+	if tx.Error != nil {
+		log.Println(tx.Error)
+		return ephemeral("aaaaaaaaaaaaaaaaaaaa something went wrong")
+	} else if tx.RowsAffected == 0 {
+		return ephemeral(fmt.Sprintf("you don't have a token #%d :thinking_face:", n))
+	}
+
+	return ephemeral(fmt.Sprintf("token #%d has been revoked", n))
+}
+
+// Finds the owner of an API token, returning false if it isn't valid
+func authenticateToken(secret string) (db.APIToken, bool) {
+	var token db.APIToken
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return token, false
+	}
+
+	if tx := db.DB.Where("hash = ?", ids.Hash(secret)).First(&token); tx.Error != nil {
+		return token, false
+	}
+
+	now := time.Now()
+	db.DB.Model(&token).Update("last_used_at", now)
+
+	return token, true
+}
@@ -0,0 +1,210 @@
+package slackevents
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/imageproxy"
+	"github.com/cjdenio/temp-email/pkg/sanitize"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The page around the email itself. Scripts can't run anywhere, and the
+// email only gets a sandboxed frame with a separate origin.
+const wrapperCSP = "default-src 'none'; style-src 'unsafe-inline'; frame-src 'self'; form-action 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// Fetches remote images for the viewer, set up in Start
+var imageProxy *imageproxy.Proxy
+
+// The email's own content. Images load from the email itself, and remote
+// ones only through the image proxy when asked for.
+func bodyCSP() string {
+	images := "data: 'self'"
+	if origin := os.Getenv("APP_DOMAIN"); origin != "" {
+		images += " " + origin
+	}
+
+	return fmt.Sprintf("default-src 'none'; style-src 'unsafe-inline'; img-src %s; font-src data:; form-action 'none'; base-uri 'none'; frame-ancestors 'self'; sandbox allow-popups allow-popups-to-escape-sandbox", images)
+}
+
+var wrapperTemplate = template.Must(template.New("wrapper").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</title>
+<style>
+html, body { margin: 0; height: 100%; }
+body { display: flex; flex-direction: column; font-family: sans-serif; }
+.bar { padding: 8px; border-bottom: 1px solid #ccc; display: flex; gap: 16px; flex-wrap: wrap; }
+.bar a { margin-left: auto; }
+iframe { flex: 1; border: 0; width: 100%; }
+</style>
+</head>
+<body>
+<div class="bar">
+<span>{{.Banner}}</span>
+{{if .RemoteImages}}<a href="?">Hide remote images</a>{{else if .BlockedImages}}<span>{{.BlockedImages}} remote image(s) blocked</span><a href="?images=1">Load remote images</a>{{end}}
+</div>
+<iframe src="{{.BodyURL}}" sandbox="allow-popups allow-popups-to-escape-sandbox" referrerpolicy="no-referrer"></iframe>
+</body>
+</html>
+`))
+
+// Looks up and parses the email in the request's :email param, responding
+// with an error if that fails
+func findEmail(c *gin.Context) (db.Email, parsemail.Email, bool) {
+	var rawEmail db.Email
+	tx := db.DB.Where("id = ?", c.Param("email")).First(&rawEmail)
+	if tx.Error == gorm.ErrRecordNotFound {
+		c.String(404, "404 email not found :(")
+		return rawEmail, parsemail.Email{}, false
+	} else if tx.Error != nil {
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return rawEmail, parsemail.Email{}, false
+	}
+
+	email, err := parsemail.Parse(strings.NewReader(rawEmail.Content))
+	if err != nil {
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return rawEmail, email, false
+	}
+
+	return rawEmail, email, true
+}
+
+func embeddedURL(emailID, cid string) string {
+	return fmt.Sprintf("/%s/embedded?%s", emailID, url.Values{"cid": {cid}}.Encode())
+}
+
+// Turns an email's body into a safe HTML document
+func renderBody(emailID string, email parsemail.Email, remoteImages bool) (sanitize.Result, error) {
+	if email.HTMLBody != "" {
+		return sanitize.HTML(email.HTMLBody, sanitize.Options{
+			AllowRemoteImages: remoteImages,
+			RewriteURL:        imageProxy.URL,
+			RewriteCID: func(cid string) string {
+				for _, f := range email.EmbeddedFiles {
+					if f.CID == cid {
+						return embeddedURL(emailID, cid)
+					}
+				}
+				return ""
+			},
+		})
+	} else if email.TextBody != "" {
+		return sanitize.Result{
+			HTML: `<pre style="white-space: pre-wrap; word-wrap: break-word; font-family: sans-serif;">` + html.EscapeString(email.TextBody) + "</pre>",
+		}, nil
+	}
+
+	return sanitize.Result{HTML: "<p>Something went wrong: this message has no content :(</p>"}, nil
+}
+
+func securityHeaders(c *gin.Context, csp string) {
+	c.Header("Content-Security-Policy", csp)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+}
+
+func handleView(c *gin.Context) {
+	rawEmail, email, ok := findEmail(c)
+	if !ok {
+		return
+	}
+
+	remoteImages := c.Query("images") == "1"
+
+	result, err := renderBody(rawEmail.ID, email, remoteImages)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return
+	}
+
+	bodyURL := fmt.Sprintf("/%s/body", rawEmail.ID)
+	if remoteImages {
+		bodyURL += "?images=1"
+	}
+
+	securityHeaders(c, wrapperCSP)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(200)
+
+	err = wrapperTemplate.Execute(c.Writer, map[string]interface{}{
+		"Subject":       email.Subject,
+		"Banner":        authBanner(rawEmail.AuthVerdict),
+		"RemoteImages":  remoteImages,
+		"BlockedImages": result.BlockedImages,
+		"BodyURL":       bodyURL,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Serves just the sanitized email, for the wrapper page's frame
+func handleViewBody(c *gin.Context) {
+	rawEmail, email, ok := findEmail(c)
+	if !ok {
+		return
+	}
+
+	remoteImages := c.Query("images") == "1"
+
+	result, err := renderBody(rawEmail.ID, email, remoteImages)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+		return
+	}
+
+	securityHeaders(c, bodyCSP())
+	c.Data(200, "text/html; charset=utf-8", []byte(result.HTML))
+}
+
+// Serves an inline part of an email, like a logo referenced with cid:
+func handleEmbedded(c *gin.Context) {
+	_, email, ok := findEmail(c)
+	if !ok {
+		return
+	}
+
+	for _, f := range email.EmbeddedFiles {
+		if f.CID != c.Query("cid") {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(f.Data)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "aaaaaaaaaaaaaaaaaaaa something went wrong")
+			return
+		}
+
+		// Only images get shown inline, and never SVGs since they can
+		// contain scripts
+		contentType, _, _ := mime.ParseMediaType(f.ContentType)
+		if !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+			contentType = "application/octet-stream"
+			c.Header("Content-Disposition", "attachment")
+		}
+
+		securityHeaders(c, "default-src 'none'; sandbox")
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Data(200, contentType, data)
+		return
+	}
+
+	c.String(404, "404 embedded file not found :(")
+}
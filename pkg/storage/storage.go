@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var ErrInvalidKey = errors.New("invalid storage key")
+
+func dir() string {
+	if d := os.Getenv("ATTACHMENT_DIR"); d != "" {
+		return d
+	}
+	return filepath.Join("data", "attachments")
+}
+
+// Keys are hex-encoded SHA-256 hashes, which also keeps them safe to use as
+// file names
+func path(key string) (string, error) {
+	if len(key) != sha256.Size*2 {
+		return "", ErrInvalidKey
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(dir(), key[:2], key), nil
+}
+
+// Put stores a blob and returns its key. Blobs are content-addressed, so
+// storing the same data twice only keeps one copy.
+func Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+
+	p, err := path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		return key, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	return key, os.Rename(tmp.Name(), p)
+}
+
+func Open(key string) (*os.File, error) {
+	p, err := path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
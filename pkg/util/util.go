@@ -1,22 +1,15 @@
 package util
 
 import (
-	"math/rand"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-func GenerateEmailAddress() string {
-	chars := []rune("abcdefghijklmnopqrstuvwxyz0123456789")
-
-	generated := ""
-
-	for i := 0; i < 6; i++ {
-		generated = generated + string(chars[rand.Intn(len(chars))])
-	}
-
-	return generated
-}
-
 // Removes @everyone, @channel, and @here
 func SanitizeInput(input string) string {
 	input = strings.ReplaceAll(input, "@channel", "[redacted]")
@@ -30,3 +23,204 @@ func SanitizeInput(input string) string {
 
 	return input
 }
+
+// Formats a byte count for humans, e.g. 1.5 MB
+func FormatSize(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
+
+// Splits text into chunks of at most size characters, preferring to break
+// between paragraphs, then between lines, then between words
+func ChunkText(text string, size int) []string {
+	var chunks []string
+	current := ""
+
+	flush := func() {
+		if strings.TrimSpace(current) != "" {
+			chunks = append(chunks, strings.TrimSpace(current))
+		}
+		current = ""
+	}
+
+	add := func(piece, sep string) {
+		if current == "" {
+			current = piece
+		} else if utf8.RuneCountInString(current)+len(sep)+utf8.RuneCountInString(piece) <= size {
+			current += sep + piece
+		} else {
+			flush()
+			current = piece
+		}
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if utf8.RuneCountInString(paragraph) <= size {
+			add(paragraph, "\n\n")
+			continue
+		}
+
+		// Long paragraphs start a chunk of their own
+		flush()
+
+		for _, line := range strings.Split(paragraph, "\n") {
+			if utf8.RuneCountInString(line) <= size {
+				add(line, "\n")
+				continue
+			}
+
+			for _, piece := range splitLine(line, size) {
+				add(piece, " ")
+			}
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// Hard-wraps a single line, breaking on a space where possible
+func splitLine(line string, size int) []string {
+	var pieces []string
+	runes := []rune(line)
+
+	for len(runes) > size {
+		cut := size
+		for i := size; i > size/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+
+		pieces = append(pieces, string(runes[:cut]))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+
+	return append(pieces, string(runes))
+}
+
+var durationPattern = regexp.MustCompile(`^(\d+|an?)\s*(m|mins?|minutes?|h|hrs?|hours?|d|days?|w|wks?|weeks?)$`)
+
+// Parses a human-friendly duration like "3 days", "12h" or "a week"
+func ParseDuration(input string) (time.Duration, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+
+	match := durationPattern.FindStringSubmatch(input)
+	if match == nil {
+		// Fall back to Go's own syntax, e.g. "1h30m"
+		return time.ParseDuration(input)
+	}
+
+	n := 1
+	if match[1] != "a" && match[1] != "an" {
+		var err error
+		n, err = strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var unit time.Duration
+	switch match[2][0] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// Formats a duration the way a person would say it, e.g. "3 days"
+func FormatDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	switch {
+	case d >= 7*24*time.Hour && d%(7*24*time.Hour) == 0:
+		return plural(int64(d/(7*24*time.Hour)), "week")
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	default:
+		return plural(int64(d/time.Minute), "minute")
+	}
+}
+
+// Renders a time with Slack's date formatting, so each user sees it in
+// their own timezone
+func SlackDate(t time.Time) string {
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} at {time}|%s>", t.Unix(), t.UTC().Format("Jan 2, 2006 at 15:04 UTC"))
+}
+
+// Local parts nobody gets to claim, on top of whatever's in RESERVED_ALIASES
+var reservedAliases = []string{
+	"abuse", "admin", "administrator", "hostmaster", "info", "mailer-daemon",
+	"no-reply", "noreply", "postmaster", "root", "security", "support", "webmaster",
+}
+
+// InvalidAliasError explains why a requested alias can't be used
+type InvalidAliasError struct {
+	Reason string
+}
+
+func (e *InvalidAliasError) Error() string {
+	return e.Reason
+}
+
+// Checks that a user-chosen local part is allowed. Aliases are a stricter
+// subset of RFC 5321's dot-atom: lowercase letters, digits, dots, hyphens
+// and underscores, with no leading, trailing or repeated dots.
+func ValidateAlias(alias string) error {
+	if len(alias) < 3 {
+		return &InvalidAliasError{"that name is too short, it needs at least 3 characters"}
+	}
+	// RFC 5321 section 4.5.3.1.1
+	if len(alias) > 64 {
+		return &InvalidAliasError{"that name is too long, it can have at most 64 characters"}
+	}
+
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '.' && c != '-' && c != '_' {
+			return &InvalidAliasError{"names can only contain lowercase letters, numbers, dots, hyphens and underscores"}
+		}
+	}
+
+	if strings.HasPrefix(alias, ".") || strings.HasSuffix(alias, ".") || strings.Contains(alias, "..") {
+		return &InvalidAliasError{"names can't start or end with a dot, or have two dots in a row"}
+	}
+
+	reserved := reservedAliases
+	for _, r := range strings.Split(os.Getenv("RESERVED_ALIASES"), ",") {
+		if r = strings.ToLower(strings.TrimSpace(r)); r != "" {
+			reserved = append(reserved, r)
+		}
+	}
+	for _, r := range reserved {
+		if alias == r {
+			return &InvalidAliasError{"sorry, that name is reserved"}
+		}
+	}
+
+	return nil
+}
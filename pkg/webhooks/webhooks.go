@@ -0,0 +1,307 @@
+// Package webhooks sends received emails to user-registered HTTP endpoints.
+// Deliveries are queued in the database and sent by a background worker,
+// which retries failures with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/ids"
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+)
+
+const (
+	// How many times a delivery is tried before it's marked as failed
+	MaxAttempts = 8
+
+	// The first retry waits this long, doubling every time after that
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+
+	// How often the worker checks for retries that are due
+	pollInterval = 10 * time.Second
+
+	// How many deliveries the worker picks up at once
+	batchSize = 20
+)
+
+// Added to webhook secrets so they're easy to recognize
+const SecretPrefix = "whsec_"
+
+// Swapped out in tests, which need to reach endpoints on loopback
+var client = safehttp.Client
+
+// Wakes the worker up when something's enqueued, so it doesn't wait for the
+// next poll
+var wake = make(chan struct{}, 1)
+
+type Payload struct {
+	Event      string              `json:"event"`
+	ID         string              `json:"id"`
+	Address    string              `json:"address"`
+	Tag        string              `json:"tag,omitempty"`
+	From       string              `json:"from"`
+	To         []string            `json:"to"`
+	Cc         []string            `json:"cc"`
+	Subject    string              `json:"subject"`
+	Date       *time.Time          `json:"date"`
+	ReceivedAt time.Time           `json:"received_at"`
+	Headers    map[string][]string `json:"headers"`
+	Text       string              `json:"text"`
+	HTML       string              `json:"html"`
+
+	Attachments []PayloadAttachment `json:"attachments"`
+
+	Auth struct {
+		Verdict string `json:"verdict"`
+		Results string `json:"results"`
+	} `json:"auth"`
+
+	URL    string `json:"url"`
+	RawURL string `json:"raw_url"`
+}
+
+type PayloadAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// NewSecret generates a signing secret for a new webhook
+func NewSecret() string {
+	return ids.Secret(SecretPrefix)
+}
+
+func buildPayload(email db.Email, address db.Address, parsed parsemail.Email, attachments []db.Attachment) Payload {
+	viewURL := fmt.Sprintf("%s/%s", os.Getenv("APP_DOMAIN"), email.ID)
+
+	payload := Payload{
+		Event:       "email.received",
+		ID:          email.ID,
+		Address:     fmt.Sprintf("%s@%s", address.ID, address.Domain),
+		Tag:         email.Tag,
+		From:        email.From,
+		To:          []string{},
+		Cc:          []string{},
+		Subject:     email.Subject,
+		ReceivedAt:  email.CreatedAt,
+		Headers:     parsed.Header,
+		Text:        parsed.TextBody,
+		HTML:        parsed.HTMLBody,
+		Attachments: []PayloadAttachment{},
+		URL:         viewURL,
+		RawURL:      viewURL + "/raw",
+	}
+
+	for _, a := range parsed.To {
+		payload.To = append(payload.To, a.String())
+	}
+	for _, a := range parsed.Cc {
+		payload.Cc = append(payload.Cc, a.String())
+	}
+	if !parsed.Date.IsZero() {
+		payload.Date = &parsed.Date
+	}
+	for _, a := range attachments {
+		payload.Attachments = append(payload.Attachments, PayloadAttachment{
+			ID:          a.ID,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			URL:         fmt.Sprintf("%s/attachments/%s", viewURL, a.ID),
+		})
+	}
+	payload.Auth.Verdict = email.AuthVerdict
+	payload.Auth.Results = email.AuthResults
+
+	return payload
+}
+
+// Enqueue queues a delivery of email to every webhook registered for its
+// address, or for all of its owner's addresses
+func Enqueue(email db.Email, address db.Address, parsed parsemail.Email, attachments []db.Attachment) {
+	var hooks []db.Webhook
+	tx := db.DB.Where("\"user\" = ? AND (address_id = '' OR address_id = ?)", address.User, address.ID).Find(&hooks)
+	if tx.Error != nil {
+		log.Println(tx.Error)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(buildPayload(email, address, parsed, attachments))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, hook := range hooks {
+		delivery := db.WebhookDelivery{
+			WebhookID:     hook.ID,
+			EmailID:       email.ID,
+			Payload:       string(body),
+			Status:        db.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		if tx := db.DB.Create(&delivery); tx.Error != nil {
+			log.Println(tx.Error)
+		}
+	}
+
+	notify()
+}
+
+// Replay queues a delivery to be sent again right away, whatever happened to
+// it before
+func Replay(delivery *db.WebhookDelivery) error {
+	delivery.Status = db.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+
+	tx := db.DB.Model(delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	notify()
+	return nil
+}
+
+func notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sign computes the signature sent in the X-Webhook-Signature header: an
+// HMAC-SHA256 of the timestamp, a period, and the body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait before the next try, after attempts tries so far
+func backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Start runs the delivery worker in the background
+func Start() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			processDue()
+
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+func processDue() {
+	var deliveries []db.WebhookDelivery
+	tx := db.DB.Joins("Webhook").Where("status = ? AND next_attempt_at <= ?", db.DeliveryPending, time.Now()).Order("next_attempt_at").Limit(batchSize).Find(&deliveries)
+	if tx.Error != nil {
+		log.Println(tx.Error)
+		return
+	}
+
+	for i := range deliveries {
+		attempt(&deliveries[i])
+	}
+}
+
+func attempt(delivery *db.WebhookDelivery) {
+	status, err := send(delivery.Webhook, delivery.ID, []byte(delivery.Payload))
+	record(delivery, status, err)
+
+	if tx := db.DB.Omit("Webhook").Save(delivery); tx.Error != nil {
+		log.Println(tx.Error)
+	}
+}
+
+// Updates a delivery with how a try went, scheduling the next one if it
+// failed and there are any left
+func record(delivery *db.WebhookDelivery, status int, err error) {
+	delivery.Attempts++
+	delivery.LastStatus = status
+	delivery.LastError = ""
+
+	if err == nil {
+		now := time.Now()
+		delivery.Status = db.DeliverySucceeded
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= MaxAttempts {
+			delivery.Status = db.DeliveryFailed
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(backoff(delivery.Attempts))
+		}
+	}
+}
+
+// Posts a payload to a webhook, returning the response status if there was
+// one. Anything other than a 2xx counts as a failure.
+func send(hook db.Webhook, deliveryID uint, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "temp-email-webhooks")
+	req.Header.Set("X-Webhook-ID", strconv.FormatUint(uint64(hook.ID), 10))
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(deliveryID), 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", Sign(hook.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
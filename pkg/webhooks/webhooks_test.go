@@ -0,0 +1,154 @@
+package webhooks
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cjdenio/temp-email/pkg/db"
+	"github.com/cjdenio/temp-email/pkg/safehttp"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		secret, timestamp, body string
+		want                    string
+	}{
+		{"whsec_test", "1700000000", `{"event":"email.received"}`, "sha256=35e13ceac6595d90368de5724a4762c8c713cf8ed893d2b2d8301af331ae6ce0"},
+		{"secret", "0", "", "sha256=3445798a051818ef95def46c2eb62b43d377ce6e3c29b4d0aec3da0e59577f79"},
+	}
+
+	for _, tt := range tests {
+		if got := Sign(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+			t.Errorf("Sign(%q, %q, %q) = %s, want %s", tt.secret, tt.timestamp, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{8, 64 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		delivery := &db.WebhookDelivery{Status: db.DeliveryPending, Attempts: 2, LastError: "endpoint responded with 500"}
+		record(delivery, 200, nil)
+
+		if delivery.Status != db.DeliverySucceeded || delivery.Attempts != 3 || delivery.LastStatus != 200 || delivery.LastError != "" {
+			t.Errorf("unexpected delivery %+v", delivery)
+		}
+		if delivery.DeliveredAt == nil || time.Since(*delivery.DeliveredAt) > time.Minute {
+			t.Errorf("DeliveredAt is %v", delivery.DeliveredAt)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		delivery := &db.WebhookDelivery{Status: db.DeliveryPending}
+		for i := 1; i < MaxAttempts; i++ {
+			before := time.Now()
+			record(delivery, 503, errors.New("endpoint responded with 503"))
+
+			if delivery.Status != db.DeliveryPending {
+				t.Fatalf("status %s after %d attempts", delivery.Status, i)
+			}
+			if delivery.Attempts != i || delivery.LastStatus != 503 || delivery.LastError != "endpoint responded with 503" || delivery.DeliveredAt != nil {
+				t.Fatalf("unexpected delivery %+v", delivery)
+			}
+			if wait := delivery.NextAttemptAt.Sub(before); wait < backoff(i) || wait > backoff(i)+time.Minute {
+				t.Errorf("next attempt in %s after %d attempts, want %s", wait, i, backoff(i))
+			}
+		}
+
+		// No response at all
+		record(delivery, 0, errors.New("connection refused"))
+		if delivery.Status != db.DeliveryFailed || delivery.Attempts != MaxAttempts {
+			t.Errorf("status %s after %d attempts", delivery.Status, delivery.Attempts)
+		}
+		if delivery.LastStatus != 0 || delivery.LastError != "connection refused" {
+			t.Errorf("unexpected delivery %+v", delivery)
+		}
+	})
+}
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	status := http.StatusOK
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer endpoint.Close()
+
+	// The endpoint is on loopback, which the real client won't talk to
+	old := client
+	client = safehttp.NewClient(true)
+	defer func() { client = old }()
+
+	hook := db.Webhook{ID: 7, URL: endpoint.URL + "/hook", Secret: "whsec_test"}
+	body := []byte(`{"event":"email.received"}`)
+
+	code, err := send(hook, 42, body)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("got %d, %v", code, err)
+	}
+
+	if got.Method != http.MethodPost || got.URL.Path != "/hook" || string(gotBody) != string(body) {
+		t.Errorf("unexpected request %s %s: %s", got.Method, got.URL.Path, gotBody)
+	}
+	headers := map[string]string{
+		"Content-Type":       "application/json",
+		"User-Agent":         "temp-email-webhooks",
+		"X-Webhook-Id":       "7",
+		"X-Webhook-Delivery": "42",
+	}
+	for name, want := range headers {
+		if v := got.Header.Get(name); v != want {
+			t.Errorf("%s is %q, want %q", name, v, want)
+		}
+	}
+
+	timestamp := got.Header.Get("X-Webhook-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > time.Minute {
+		t.Errorf("X-Webhook-Timestamp is %q", timestamp)
+	}
+	if sig := got.Header.Get("X-Webhook-Signature"); sig != Sign(hook.Secret, timestamp, body) {
+		t.Errorf("X-Webhook-Signature is %q", sig)
+	}
+
+	status = http.StatusInternalServerError
+	if code, err := send(hook, 42, body); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("got %d, %v for a 500", code, err)
+	}
+
+	// The real client refuses to connect at all
+	client = old
+	if code, err := send(hook, 42, body); err == nil || code != 0 {
+		t.Errorf("got %d, %v connecting to loopback", code, err)
+	}
+}